@@ -1,4 +1,4 @@
 module kutta
 
-go 1.17
+go 1.18
 
@@ -0,0 +1,176 @@
+package kutta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"sync"
+)
+
+// A changeOp is the kind of one change log record.
+type changeOp uint8
+
+const (
+	changePut changeOp = iota
+	changeRemove
+	changeClear
+	changeInvalidate
+)
+
+// change is the gob representation of one change log record. Deadline
+// is an absolute time in nanoseconds, or zero for none. Negative marks
+// a put that records a loader finding no value for Key.
+type change struct {
+	Op       changeOp
+	Key      Key
+	Value    interface{}
+	Deadline int64
+	Negative bool
+}
+
+// A changeLog encodes the changes made by each write into buf under
+// the cache lock, while their values cannot change. unlock moves the
+// encoded records to queue, and they are written to w after the cache
+// lock is released, so a slow w never holds up the cache.
+type changeLog struct {
+	w   io.Writer
+	buf bytes.Buffer // guarded by the cache lock, like enc
+	enc *gob.Encoder
+
+	mu    sync.Mutex // guards queue; never held while writing
+	queue []byte
+
+	wmu sync.Mutex // serializes writes to w
+}
+
+// EnableChangeLog makes the cache write a record of every change to its
+// contents to w, as a gob stream a follower replays with ApplyChange to
+// stay in sync without exchanging full snapshots. A nil w disables it.
+//
+// Records are encoded under the cache lock and written after it is
+// released, in the order the changes were made. Stores, including
+// in-place updates and new deadlines, removals for any reason, Clear
+// and InvalidateAll are recorded; Close and Drain are not, so a
+// follower keeps its entries when the leader shuts down. Only changes
+// made after EnableChangeLog are recorded, so a follower should start
+// from a Save taken before any of them. Deadlines are recorded as
+// absolute times, so the follower must share the leader's clock, as
+// processes on one host do. As with Save, key and value types must be
+// registered with gob.Register, and entries that gob cannot encode are
+// skipped and reported to the Logger. A write to w that fails is
+// reported to the Logger and its records are lost.
+func (c *Cache) EnableChangeLog(w io.Writer) {
+	c.lock()
+	defer c.unlock()
+	if w == nil {
+		c.changeLog = nil
+		return
+	}
+	cl := &changeLog{w: w}
+	cl.enc = gob.NewEncoder(&cl.buf)
+	c.changeLog = cl
+}
+
+// ApplyChange reads change records written by a leader's
+// EnableChangeLog from r and applies each as it arrives, until r
+// reports io.EOF, when it returns nil. A follower's own writes are not
+// prevented, but may be overwritten by the leader's.
+func (c *Cache) ApplyChange(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var ch change
+		if err := dec.Decode(&ch); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		c.apply(ch)
+	}
+}
+
+func (c *Cache) apply(ch change) {
+	c.lock()
+	defer c.unlock()
+	switch ch.Op {
+	case changePut:
+		c.putAt(ch.Key, ch.Value, ch.Deadline, c.now(), nil, c.sizeOf(ch.Value))
+		if ele, hit := c.cache[ch.Key]; hit && ch.Negative {
+			ele.Value.(*entry).negative = true
+		}
+	case changeRemove:
+		if ele, hit := c.cache[ch.Key]; hit {
+			c.removeElement(ele)
+		}
+	case changeClear:
+		c.logOp(changeClear)
+		c.clear()
+	case changeInvalidate:
+		c.invalidateAll()
+	}
+}
+
+// logPut records that kv holds its current value and deadline.
+func (c *Cache) logPut(kv *entry) {
+	if c.changeLog != nil {
+		c.logChange(change{Op: changePut, Key: kv.key, Value: kv.value, Deadline: kv.Expiration, Negative: kv.negative})
+	}
+}
+
+// logRemove records that key left the cache.
+func (c *Cache) logRemove(key Key) {
+	if c.changeLog != nil {
+		c.logChange(change{Op: changeRemove, Key: key})
+	}
+}
+
+// logOp records a change to the whole cache.
+func (c *Cache) logOp(op changeOp) {
+	if c.changeLog != nil {
+		c.logChange(change{Op: op})
+	}
+}
+
+func (c *Cache) logChange(ch change) {
+	if !gobbable(ch.Key) || !gobbable(ch.Value) {
+		c.infof("kutta: not logging change to %v: key or value of type %T cannot be encoded", ch.Key, ch.Value)
+		return
+	}
+	if err := c.changeLog.enc.Encode(ch); err != nil {
+		c.infof("kutta: logging change to %v: %v", ch.Key, err)
+	}
+}
+
+// flush queues the records of the write ending under c's lock, which
+// must be held, and returns a func that writes them to w after the lock
+// is released, or nil if there are none. Records are queued in the
+// order of the writes, and each call of the func writes everything
+// queued so far, so they reach w in that order too.
+func (cl *changeLog) flush(c *Cache) func() {
+	if cl == nil || cl.buf.Len() == 0 {
+		return nil
+	}
+	cl.mu.Lock()
+	cl.queue = append(cl.queue, cl.buf.Bytes()...)
+	cl.mu.Unlock()
+	cl.buf.Reset()
+	return func() { cl.write(c) }
+}
+
+// write writes the queued records to w.
+func (cl *changeLog) write(c *Cache) {
+	cl.wmu.Lock()
+	defer cl.wmu.Unlock()
+	cl.mu.Lock()
+	queue := cl.queue
+	cl.queue = nil
+	cl.mu.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+	if _, err := cl.w.Write(queue); err != nil {
+		c.mu.RLock()
+		c.infof("kutta: writing change log: %v", err)
+		c.mu.RUnlock()
+	}
+}
@@ -0,0 +1,59 @@
+package kutta
+
+import "time"
+
+// A debouncedWrite is the latest AddDebounced write to a key, waiting
+// for its window to close.
+type debouncedWrite struct {
+	value interface{}
+	d     time.Duration
+	timer *time.Timer
+}
+
+// AddDebounced is like AddEx for keys updated many times in quick
+// succession, such as counters and last-seen times. The first write to
+// key starts a window of the given length; writes within it only replace
+// the buffered value and ttl, and the last of them is stored, taking the
+// cache lock once, when the window closes. Until then readers see the
+// value from before the window. Drain stores buffered writes before
+// draining, so it sees them.
+func (c *Cache) AddDebounced(key Key, value interface{}, d, window time.Duration) {
+	c.debounceMu.Lock()
+	defer c.debounceMu.Unlock()
+	if w, ok := c.debounced[key]; ok {
+		w.value, w.d = value, d
+		return
+	}
+	if c.debounced == nil {
+		c.debounced = make(map[interface{}]*debouncedWrite)
+	}
+	w := &debouncedWrite{value: value, d: d}
+	w.timer = time.AfterFunc(window, func() { c.flushDebounced(key, w) })
+	c.debounced[key] = w
+}
+
+// flushDebounced stores w if it is still the buffered write for key.
+func (c *Cache) flushDebounced(key Key, w *debouncedWrite) {
+	c.debounceMu.Lock()
+	if c.debounced[key] != w {
+		c.debounceMu.Unlock()
+		return
+	}
+	delete(c.debounced, key)
+	value, d := w.value, w.d
+	c.debounceMu.Unlock()
+	c.AddEx(key, value, d)
+}
+
+// FlushDebounced stores every buffered AddDebounced write now, without
+// waiting for its window to close.
+func (c *Cache) FlushDebounced() {
+	c.debounceMu.Lock()
+	writes := c.debounced
+	c.debounced = nil
+	c.debounceMu.Unlock()
+	for key, w := range writes {
+		w.timer.Stop()
+		c.AddEx(key, w.value, w.d)
+	}
+}
@@ -0,0 +1,15 @@
+package kutta
+
+import "time"
+
+// expireNow moves key's deadline into the past so tests can exercise
+// expiration without sleeping.
+func (c *Cache) expireNow(key Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, hit := c.cache[key]; hit {
+		kv := ele.Value.(*entry)
+		kv.Expiration = time.Now().Add(-time.Second).UnixNano()
+		c.indexExpiration(kv)
+	}
+}
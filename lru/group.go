@@ -0,0 +1,154 @@
+package kutta
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A CacheGroup enforces one byte budget across several caches. Caches
+// report their tracked bytes, set by AddWithSize, WithSizer and
+// WithKeyCost, to the group as they change; whenever a write leaves the
+// group over its limit, entries are evicted from the member caches in
+// round-robin order, each choosing its victim as capacity eviction
+// would, until it fits again.
+type CacheGroup struct {
+	maxBytes int64
+	used     int64 // accessed atomically
+
+	mu     sync.Mutex // serializes enforcement and protects caches and next
+	caches []*Cache
+	next   int
+}
+
+// NewCacheGroup returns a group that holds its members to maxBytes in
+// total.
+func NewCacheGroup(maxBytes int64) *CacheGroup {
+	return &CacheGroup{maxBytes: maxBytes}
+}
+
+// Register adds c to the group. A cache belongs to at most one group.
+// Registering a member again has no effect.
+func (g *CacheGroup) Register(c *Cache) {
+	g.mu.Lock()
+	for _, m := range g.caches {
+		if m == c {
+			g.mu.Unlock()
+			return
+		}
+	}
+	g.caches = append(g.caches, c)
+	g.mu.Unlock()
+	c.lock()
+	c.group = g
+	atomic.AddInt64(&g.used, c.bytes)
+	c.unlock()
+}
+
+// Unregister removes c from the group.
+func (g *CacheGroup) Unregister(c *Cache) {
+	g.mu.Lock()
+	for i, m := range g.caches {
+		if m == c {
+			g.caches = append(g.caches[:i], g.caches[i+1:]...)
+			break
+		}
+	}
+	g.mu.Unlock()
+	c.lock()
+	if c.group == g {
+		c.group = nil
+		atomic.AddInt64(&g.used, -c.bytes)
+	}
+	c.unlock()
+}
+
+// Bytes returns the bytes tracked across all member caches.
+func (g *CacheGroup) Bytes() int64 {
+	return atomic.LoadInt64(&g.used)
+}
+
+func (g *CacheGroup) over() bool {
+	return atomic.LoadInt64(&g.used) > g.maxBytes
+}
+
+// enforce evicts from member caches until the group is within budget.
+// It must be called without any member's lock held. g.mu is released
+// while a member sheds, so eviction callbacks that write to a member
+// can enforce the budget themselves instead of deadlocking.
+func (g *CacheGroup) enforce() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for empty := 0; g.over() && len(g.caches) > 0 && empty < len(g.caches); {
+		g.next %= len(g.caches)
+		c := g.caches[g.next]
+		g.next++
+		g.mu.Unlock()
+		shed := c.shed()
+		g.mu.Lock()
+		if !shed {
+			empty++
+			continue
+		}
+		empty = 0
+	}
+}
+
+// AddWithSize is like AddEx but records that the entry occupies size
+// bytes, overriding any Sizer until the value is next replaced. It
+// reports false and stores nothing if size exceeds the limit set by
+// WithMaxValueSize or the cache is closed.
+func (c *Cache) AddWithSize(key Key, value interface{}, d time.Duration, size int64) bool {
+	c.lock()
+	defer c.unlock()
+	_, ok := c.put(key, value, d, nil, size)
+	return ok
+}
+
+// Bytes returns the total size of the entries in the cache, as given to
+// AddWithSize or computed by the Sizer.
+func (c *Cache) Bytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bytes
+}
+
+// setSize records e's size, given the size of its value, and updates
+// the cache and group totals.
+func (c *Cache) setSize(e *entry, size int64) {
+	size += c.keySize(e.key)
+	c.addBytes(size - e.size)
+	e.size = size
+}
+
+func (c *Cache) addBytes(delta int64) {
+	c.bytes += delta
+	if c.group != nil {
+		atomic.AddInt64(&c.group.used, delta)
+	}
+}
+
+// sizeOf returns the Sizer's measure of value, or zero without one.
+func (c *Cache) sizeOf(value interface{}) int64 {
+	if c.sizer == nil {
+		return 0
+	}
+	return c.sizer(value)
+}
+
+// keySize returns the KeyCost of key, or zero without one.
+func (c *Cache) keySize(key Key) int64 {
+	if c.keyCost == nil {
+		return 0
+	}
+	return c.keyCost(key)
+}
+
+// StringKeyCost is a KeyCost for WithKeyCost counting the length of
+// string keys. Keys of other types cost nothing.
+func StringKeyCost(key Key) int64 {
+	if s, ok := key.(string); ok {
+		return int64(len(s))
+	}
+	return 0
+}
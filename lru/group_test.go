@@ -0,0 +1,95 @@
+package kutta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheGroup(t *testing.T) {
+	g := NewCacheGroup(100)
+	sizer := func(value interface{}) int64 { return int64(len(value.(string))) }
+	a := New(0, time.Hour, WithSizer(sizer))
+	b := New(0, time.Hour)
+	g.Register(a)
+	g.Register(b)
+
+	a.Add("a1", string(make([]byte, 40)))
+	b.AddWithSize("b1", "x", NoExpiration, 40)
+	if g.Bytes() != 80 {
+		t.Fatalf("group Bytes = %d; want 80", g.Bytes())
+	}
+	a.Add("a2", string(make([]byte, 40)))
+	if g.Bytes() > 100 {
+		t.Fatalf("group Bytes = %d; want at most 100", g.Bytes())
+	}
+	if a.Len()+b.Len() != 2 {
+		t.Fatalf("entries = %d; want 2 after one eviction", a.Len()+b.Len())
+	}
+	if _, ok := a.Get("a2"); !ok {
+		t.Error("newest entry was evicted")
+	}
+
+	g.Unregister(b)
+	if g.Bytes() != a.Bytes() {
+		t.Errorf("group Bytes = %d after Unregister; want %d", g.Bytes(), a.Bytes())
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	sizer := func(value interface{}) int64 { return int64(len(value.(string))) }
+	cache := New(0, time.Hour, WithSizer(sizer), WithMaxValueSize(10))
+	cache.Add("k", "small")
+	cache.Add("k", "far too large")
+	if _, ok := cache.Get("k"); ok {
+		t.Fatal("oversized value left the old one in place")
+	}
+	if !cache.AddWithSize("a", "x", NoExpiration, 10) || cache.AddWithSize("b", "x", 0, 11) {
+		t.Fatal("AddWithSize admitted the wrong values")
+	}
+	if cache.Len() != 1 || cache.Bytes() != 10 {
+		t.Fatalf("Len, Bytes = %d, %d; want 1, 10", cache.Len(), cache.Bytes())
+	}
+}
+
+func TestKeyCost(t *testing.T) {
+	cache := New(0, time.Hour, WithKeyCost(StringKeyCost))
+	cache.AddWithSize("https://example.com/", "page", NoExpiration, 100)
+	cache.AddWithSize(42, "answer", NoExpiration, 10)
+	if got := cache.Bytes(); got != 100+20+10 {
+		t.Fatalf("Bytes = %d; want 130", got)
+	}
+	cache.Remove("https://example.com/")
+	if got := cache.Bytes(); got != 10 {
+		t.Fatalf("Bytes = %d after Remove; want 10", got)
+	}
+	cache.ReplaceAll([]Item{{Key: "abc", Value: 1, TTL: NoExpiration}})
+	if err := cache.VerifyInvariants(); err != nil || cache.Bytes() != 3 {
+		t.Fatalf("Bytes = %d, %v after ReplaceAll; want 3", cache.Bytes(), err)
+	}
+}
+
+func TestCacheGroupMultipleEvictions(t *testing.T) {
+	g := NewCacheGroup(10)
+	cache := New(0, time.Hour)
+	g.Register(cache)
+	g.Register(cache)
+	for i := 0; i < 10; i++ {
+		cache.AddWithSize(i, i, NoExpiration, 1)
+	}
+	if g.Bytes() != 10 {
+		t.Fatalf("group Bytes = %d; want 10 with the cache registered once", g.Bytes())
+	}
+	done := make(chan struct{})
+	go func() {
+		cache.AddWithSize("big", 0, NoExpiration, 5)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a write needing several evictions deadlocked")
+	}
+	if g.Bytes() > 10 || cache.Len() != 6 {
+		t.Fatalf("group Bytes = %d with %d entries; want 10 and 6", g.Bytes(), cache.Len())
+	}
+}
@@ -0,0 +1,145 @@
+package kutta
+
+import (
+	"sync"
+	"time"
+)
+
+// A HashedCache is a Cache for keys that cannot be map keys, such as
+// structs holding slices, identified instead by a hash and an equality
+// function. Each key is mapped to a comparable handle under which the
+// entry is stored in the underlying Cache.
+//
+// Every operation hashes the key and compares it against the keys
+// sharing its hash before the usual map lookup, so it is slower than a
+// Cache with native keys by the cost of hash and equal, plus a second
+// lock. Handles of keys that left the cache are swept out when they
+// outnumber the entries two to one, in O(n) time amortized over the
+// adds that created them.
+//
+// Options and callbacks given the underlying cache's keys, such as
+// WithCanEvict, see the handles rather than the keys.
+type HashedCache struct {
+	c     *Cache
+	hash  func(Key) uint64
+	equal func(a, b Key) bool
+
+	mu      sync.RWMutex // protects buckets and handles
+	buckets map[uint64][]*handle
+	handles int
+}
+
+// A handle stands in for a HashedCache key in the underlying Cache.
+type handle struct {
+	key  Key
+	hash uint64
+}
+
+// NewHashed creates a HashedCache identifying keys by hash and equal,
+// which must agree: equal keys must have the same hash. The remaining
+// arguments are as for New.
+func NewHashed(maxEntries int, cleanupInterval time.Duration, hash func(Key) uint64,
+	equal func(a, b Key) bool, opts ...Option) *HashedCache {
+	return &HashedCache{
+		c:       New(maxEntries, cleanupInterval, opts...),
+		hash:    hash,
+		equal:   equal,
+		buckets: make(map[uint64][]*handle),
+	}
+}
+
+// find returns key's handle, or nil. h.mu must be held.
+func (h *HashedCache) find(key Key, hash uint64) *handle {
+	for _, k := range h.buckets[hash] {
+		if h.equal(k.key, key) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Add stores value under key without a deadline, see Cache.Add.
+func (h *HashedCache) Add(key Key, value interface{}) {
+	h.AddEx(key, value, NoExpiration)
+}
+
+// AddEx stores value under key with the ttl d, see Cache.AddEx.
+func (h *HashedCache) AddEx(key Key, value interface{}, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash := h.hash(key)
+	k := h.find(key, hash)
+	if k == nil {
+		k = &handle{key: key, hash: hash}
+		h.buckets[hash] = append(h.buckets[hash], k)
+		h.handles++
+	}
+	h.c.AddEx(k, value, d)
+	if h.handles > 2*h.c.Len()+sparseMinPeak {
+		h.sweep()
+	}
+}
+
+// sweep drops the handles of keys no longer in the cache. h.mu must be
+// held.
+func (h *HashedCache) sweep() {
+	h.c.mu.RLock()
+	defer h.c.mu.RUnlock()
+	for hash, bucket := range h.buckets {
+		kept := bucket[:0]
+		for _, k := range bucket {
+			if _, ok := h.c.cache[k]; ok {
+				kept = append(kept, k)
+			}
+		}
+		for i := len(kept); i < len(bucket); i++ {
+			bucket[i] = nil
+		}
+		h.handles -= len(bucket) - len(kept)
+		if len(kept) == 0 {
+			delete(h.buckets, hash)
+		} else {
+			h.buckets[hash] = kept
+		}
+	}
+}
+
+// Get looks up key, see Cache.Get.
+func (h *HashedCache) Get(key Key) (value interface{}, ok bool) {
+	h.mu.RLock()
+	k := h.find(key, h.hash(key))
+	h.mu.RUnlock()
+	if k == nil {
+		h.c.countMiss()
+		return nil, false
+	}
+	return h.c.Get(k)
+}
+
+// Remove removes key.
+func (h *HashedCache) Remove(key Key) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash := h.hash(key)
+	bucket := h.buckets[hash]
+	for i, k := range bucket {
+		if h.equal(k.key, key) {
+			h.c.Remove(k)
+			bucket[i] = bucket[len(bucket)-1]
+			bucket[len(bucket)-1] = nil
+			h.buckets[hash] = bucket[:len(bucket)-1]
+			h.handles--
+			return
+		}
+	}
+}
+
+// Len returns the number of entries, see Cache.Len.
+func (h *HashedCache) Len() int {
+	return h.c.Len()
+}
+
+// Close releases the cache's watchdog, see Cache.Close.
+func (h *HashedCache) Close() {
+	h.c.Close()
+}
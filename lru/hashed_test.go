@@ -0,0 +1,53 @@
+package kutta
+
+import (
+	"hash/fnv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pathKey struct {
+	parts []string
+}
+
+func hashPath(k Key) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(k.(pathKey).parts, "/")))
+	return h.Sum64()
+}
+
+func equalPath(a, b Key) bool {
+	return strings.Join(a.(pathKey).parts, "/") == strings.Join(b.(pathKey).parts, "/")
+}
+
+func TestHashedCache(t *testing.T) {
+	h := NewHashed(0, time.Hour, hashPath, equalPath)
+	defer h.Close()
+	h.Add(pathKey{[]string{"a", "b"}}, 1)
+	h.Add(pathKey{[]string{"a", "b"}}, 2)
+	if v, ok := h.Get(pathKey{[]string{"a", "b"}}); !ok || v != 2 || h.Len() != 1 {
+		t.Fatalf("Get = %v, %v with Len %d; want 2, true, 1", v, ok, h.Len())
+	}
+	if _, ok := h.Get(pathKey{[]string{"a"}}); ok {
+		t.Fatal("Get found a key that was never added")
+	}
+	h.Remove(pathKey{[]string{"a", "b"}})
+	if _, ok := h.Get(pathKey{[]string{"a", "b"}}); ok || h.handles != 0 {
+		t.Fatalf("Remove left the entry or %d handles", h.handles)
+	}
+}
+
+func TestHashedCacheSweep(t *testing.T) {
+	h := NewHashed(10, time.Hour, hashPath, equalPath)
+	defer h.Close()
+	for i := 0; i < 1000; i++ {
+		h.Add(pathKey{[]string{strings.Repeat("x", i)}}, i)
+	}
+	if h.handles > 2*10+sparseMinPeak {
+		t.Fatalf("%d handles for 10 entries; want evicted keys swept", h.handles)
+	}
+	if v, ok := h.Get(pathKey{[]string{strings.Repeat("x", 999)}}); !ok || v != 999 {
+		t.Fatalf("Get = %v, %v; want the newest entry", v, ok)
+	}
+}
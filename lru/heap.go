@@ -0,0 +1,61 @@
+package kutta
+
+import "container/heap"
+
+// expHeap is a min-heap of entries ordered by Expiration. Each entry
+// records its position in index so it can be fixed or removed in
+// O(log n) when it is updated or leaves the cache.
+type expHeap []*entry
+
+func (h expHeap) Len() int           { return len(h) }
+func (h expHeap) Less(i, j int) bool { return h[i].Expiration < h[j].Expiration }
+
+func (h expHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+// sync brings e's heap membership in line with its Expiration.
+func (h *expHeap) sync(e *entry) {
+	switch {
+	case e.index >= 0 && e.hasTTL():
+		heap.Fix(h, e.index)
+	case e.index >= 0:
+		heap.Remove(h, e.index)
+	case e.hasTTL():
+		heap.Push(h, e)
+	}
+}
+
+// remove drops e from the heap if it is a member.
+func (h *expHeap) remove(e *entry) {
+	if e.index >= 0 {
+		heap.Remove(h, e.index)
+	}
+}
+
+// countDue returns how many entries in the subtree rooted at i expired
+// before now, visiting only those entries and their children.
+func (h expHeap) countDue(i int, now int64) int {
+	if i >= len(h) || h[i].Expiration >= now {
+		return 0
+	}
+	return 1 + h.countDue(2*i+1, now) + h.countDue(2*i+2, now)
+}
@@ -0,0 +1,107 @@
+package kutta
+
+import (
+	"sync"
+	"time"
+)
+
+// Idempotency tracks idempotency keys, such as those sent with retried
+// HTTP requests, so that the first request with a key does the work and
+// its retries receive the first request's result. It reserves keys with
+// Cache.Reserve and stores results as cache entries, so completed
+// results expire like any other entry.
+type Idempotency struct {
+	c *Cache
+
+	mu      sync.Mutex // protects pending
+	pending map[interface{}]*idemRequest
+}
+
+// An idemRequest is a key begun but not yet completed.
+type idemRequest struct {
+	ttl   time.Duration
+	timer *time.Timer // abandons the key after ttl; nil without one
+}
+
+// NewIdempotency creates an Idempotency remembering at most maxKeys
+// results, zero meaning no limit, cleaned up every cleanupInterval as
+// New does.
+func NewIdempotency(maxKeys int, cleanupInterval time.Duration, opts ...Option) *Idempotency {
+	return &Idempotency{
+		c:       New(maxKeys, cleanupInterval, opts...),
+		pending: make(map[interface{}]*idemRequest),
+	}
+}
+
+// Begin starts the request with key. If no request with key is in
+// progress or completed within its ttl, isNew is true and the caller
+// must do the work and call Complete, or Abandon to let a retry do it.
+// If the caller never does, as when it crashes, the key is abandoned
+// after ttl. Otherwise wait returns the first request's result,
+// blocking until it completes, or reports false if it is abandoned.
+// ttl follows the rules of AddEx: with a negative ttl, such as
+// NoExpiration, the key is never abandoned for lack of a Complete and
+// its result is kept without a deadline, and with a zero ttl it is
+// never abandoned either but its result is not kept once the waiting
+// retries have it.
+func (id *Idempotency) Begin(key Key, ttl time.Duration) (isNew bool, wait func() (interface{}, bool)) {
+	reserved, wait := id.c.Reserve(key)
+	if !reserved {
+		return false, wait
+	}
+	r := &idemRequest{ttl: ttl}
+	id.mu.Lock()
+	id.pending[key] = r
+	if ttl > 0 {
+		r.timer = time.AfterFunc(ttl, func() { id.end(key, r) })
+	}
+	id.mu.Unlock()
+	return true, nil
+}
+
+// Complete records result as the outcome of the request with key,
+// releasing its waiting retries, and keeps it for the ttl given to
+// Begin. It reports false, storing nothing, if key was not begun or
+// has been abandoned.
+func (id *Idempotency) Complete(key Key, result interface{}) bool {
+	r := id.take(key, nil)
+	if r == nil {
+		return false
+	}
+	id.c.Fulfill(key, result, r.ttl)
+	return true
+}
+
+// Abandon gives up the request with key, so its waiting retries report
+// false and the next Begin with key starts afresh.
+func (id *Idempotency) Abandon(key Key) {
+	id.end(key, nil)
+}
+
+// end abandons key if it is pending, and is r unless r is nil.
+func (id *Idempotency) end(key Key, r *idemRequest) {
+	if id.take(key, r) != nil {
+		id.c.Abandon(key)
+	}
+}
+
+// take removes and returns the pending request for key, if there is
+// one and it is r unless r is nil.
+func (id *Idempotency) take(key Key, r *idemRequest) *idemRequest {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	p, ok := id.pending[key]
+	if !ok || r != nil && p != r {
+		return nil
+	}
+	delete(id.pending, key)
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	return p
+}
+
+// Close releases the cache's watchdog, see Cache.Close.
+func (id *Idempotency) Close() {
+	id.c.Close()
+}
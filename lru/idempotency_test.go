@@ -0,0 +1,69 @@
+package kutta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	id := NewIdempotency(0, time.Hour)
+	defer id.Close()
+	isNew, _ := id.Begin("req", time.Hour)
+	if !isNew {
+		t.Fatal("the first Begin was not new")
+	}
+	isNew, wait := id.Begin("req", time.Hour)
+	if isNew {
+		t.Fatal("a retry was new while the first request ran")
+	}
+	done := make(chan interface{})
+	go func() {
+		v, _ := wait()
+		done <- v
+	}()
+	if !id.Complete("req", "response") {
+		t.Fatal("Complete reported the key was not begun")
+	}
+	if v := <-done; v != "response" {
+		t.Fatalf("waiting retry got %v; want response", v)
+	}
+	if isNew, wait := id.Begin("req", time.Hour); isNew {
+		t.Fatal("a retry after completion was new")
+	} else if v, ok := wait(); !ok || v != "response" {
+		t.Fatalf("completed retry got %v, %v; want response", v, ok)
+	}
+}
+
+func TestIdempotencyCrash(t *testing.T) {
+	id := NewIdempotency(0, time.Hour)
+	defer id.Close()
+	id.Begin("req", 10*time.Millisecond)
+	_, wait := id.Begin("req", time.Hour)
+	if _, ok := wait(); ok {
+		t.Fatal("a retry got a result from a request that never completed")
+	}
+	if isNew, _ := id.Begin("req", time.Hour); !isNew {
+		t.Fatal("the key was not released after its ttl")
+	}
+	if id.Complete("other", 1) {
+		t.Fatal("Complete accepted a key that was never begun")
+	}
+}
+
+func TestIdempotencyWithoutDeadline(t *testing.T) {
+	id := NewIdempotency(0, time.Hour)
+	defer id.Close()
+	for _, ttl := range []time.Duration{NoExpiration, 0} {
+		key := fmt.Sprint("req", ttl)
+		id.Begin(key, ttl)
+		time.Sleep(5 * time.Millisecond)
+		if !id.Complete(key, "response") {
+			t.Fatalf("ttl %v: the key was abandoned before Complete", ttl)
+		}
+		isNew, _ := id.Begin(key, ttl)
+		if want := ttl == 0; isNew != want {
+			t.Fatalf("ttl %v: Begin after Complete isNew = %v; want %v", ttl, isNew, want)
+		}
+	}
+}
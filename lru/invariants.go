@@ -0,0 +1,49 @@
+package kutta
+
+import "fmt"
+
+// VerifyInvariants checks the cache's internal structures against each
+// other and returns an error describing the first inconsistency found,
+// or nil. It walks every entry under the read lock, so it is meant for
+// tests and debugging rather than production paths.
+func (c *Cache) VerifyInvariants() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cache == nil {
+		return nil
+	}
+	if len(c.cache) != c.dl.Len() {
+		return fmt.Errorf("kutta: map holds %d keys but list holds %d entries", len(c.cache), c.dl.Len())
+	}
+	var bytes int64
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if c.cache[kv.key] != ele {
+			return fmt.Errorf("kutta: list entry %v is not the map's element for its key", kv.key)
+		}
+		if c.expiry != nil && kv.index >= 0 &&
+			(kv.index >= len(*c.expiry) || (*c.expiry)[kv.index] != kv) {
+			return fmt.Errorf("kutta: entry %v has stale expiration index %d", kv.key, kv.index)
+		}
+		bytes += kv.size
+	}
+	if bytes != c.bytes {
+		return fmt.Errorf("kutta: byte total is %d but entry sizes sum to %d", c.bytes, bytes)
+	}
+	if c.expiry != nil {
+		for i, kv := range *c.expiry {
+			if kv.index != i {
+				return fmt.Errorf("kutta: entry %v at expiration index %d records index %d", kv.key, i, kv.index)
+			}
+			if _, hit := c.cache[kv.key]; !hit {
+				return fmt.Errorf("kutta: expiration index holds removed key %v", kv.key)
+			}
+		}
+	}
+	for alias, primary := range c.aliases {
+		if _, hit := c.cache[primary]; !hit {
+			return fmt.Errorf("kutta: alias %v refers to missing key %v", alias, primary)
+		}
+	}
+	return nil
+}
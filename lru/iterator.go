@@ -0,0 +1,57 @@
+package kutta
+
+import "container/list"
+
+// An Iterator walks the live entries of a cache from most to least
+// recently used, taking the read lock for each step only, so it can
+// stream a large cache while other goroutines keep using it.
+//
+// Iteration is weakly consistent: entries added or promoted during
+// iteration may be missed, an entry that moves behind the cursor may be
+// seen twice, and if both the entry last returned and the one after it
+// are removed between steps the iteration ends early.
+type Iterator struct {
+	c          *Cache
+	last, next *list.Element
+	started    bool
+}
+
+// Iterator returns an Iterator positioned before the most recently used
+// entry.
+func (c *Cache) Iterator() *Iterator {
+	return &Iterator{c: c}
+}
+
+// Next returns the next live entry, or ok false when the iteration is
+// over.
+func (it *Iterator) Next() (key Key, value interface{}, ok bool) {
+	c := it.c
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cache == nil {
+		return nil, nil, false
+	}
+	ele := it.next
+	if !it.started {
+		ele, it.started = c.dl.Front(), true
+	} else if !c.contains(ele) {
+		ele = nil
+		if c.contains(it.last) {
+			ele = it.last.Next()
+		}
+	}
+	now := c.now()
+	for ; ele != nil; ele = ele.Next() {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expiredAt(kv, now) {
+			it.last, it.next = ele, ele.Next()
+			return kv.key, kv.value, true
+		}
+	}
+	it.last, it.next = nil, nil
+	return nil, nil, false
+}
+
+// contains reports whether ele is still an element of the cache.
+func (c *Cache) contains(ele *list.Element) bool {
+	return ele != nil && c.cache[ele.Value.(*entry).key] == ele
+}
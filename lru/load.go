@@ -0,0 +1,327 @@
+package kutta
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLoadInProgress is returned by GetOrCompute, with WithFailFastLoads,
+// when another caller is already loading the key.
+var ErrLoadInProgress = errors.New("kutta: load already in progress")
+
+// ErrAbandoned is returned by GetOrCompute calls that waited on a key
+// reserved with Reserve when the reservation is abandoned.
+var ErrAbandoned = errors.New("kutta: reservation abandoned")
+
+// Warm loads every key with loader, running at most concurrency loads
+// at a time, and stores each result with the ttl the loader returned.
+// It stops starting new loads once ctx is done or a load fails, and
+// returns the first error encountered, or ctx.Err() if ctx ended first,
+// or ErrClosed if the cache is closed.
+// Results loaded before the failure are kept.
+func (c *Cache) Warm(ctx context.Context, keys []Key, concurrency int,
+	loader func(ctx context.Context, key Key) (interface{}, time.Duration, error)) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	sem := make(chan struct{}, concurrency)
+	for _, key := range keys {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			fail(ctx.Err())
+			break
+		}
+		wg.Add(1)
+		go func(key Key) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ctx, span := c.trace(ctx, "kutta.load", key)
+			value, d, err := loader(ctx, key)
+			span.End(err)
+			if err != nil {
+				fail(err)
+				return
+			}
+			c.AddEx(key, value, d)
+		}(key)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// GetBatch returns the values of keys, serving what it can from the
+// cache and calling loader once with the remaining keys. Loaded values
+// are stored with ttl and included in the result. Keys the loader does
+// not return are left out of the result and, with WithNegativeTTL,
+// remembered as missing so later batches do not request them again.
+// If loader fails, the cached values found so far are returned with its
+// error.
+func (c *Cache) GetBatch(ctx context.Context, keys []Key,
+	loader func(ctx context.Context, missing []Key) (map[Key]interface{}, error), ttl time.Duration) (map[Key]interface{}, error) {
+	found := make(map[Key]interface{}, len(keys))
+	var missing []Key
+	seen := make(map[Key]bool, len(keys))
+	c.lock()
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if v, ok := c.get(key); ok {
+			found[key] = v
+		} else if !c.knownMissing(key) {
+			missing = append(missing, key)
+		}
+	}
+	c.unlock()
+	ctx, span := c.trace(ctx, "kutta.GetBatch", nil)
+	span.SetHit(len(missing) == 0)
+	if len(missing) == 0 {
+		span.End(nil)
+		return found, nil
+	}
+
+	lctx, lspan := c.trace(ctx, "kutta.load", nil)
+	loaded, err := loader(lctx, missing)
+	lspan.End(err)
+	span.End(err)
+	if err != nil {
+		return found, err
+	}
+	c.lock()
+	defer c.unlock()
+	for _, key := range missing {
+		if v, ok := loaded[key]; ok {
+			c.add(key, v, ttl, nil)
+			found[key] = v
+		} else if c.negativeTTL > 0 && c.live(key) == nil {
+			// A value stored since the miss above is kept.
+			c.add(key, nil, c.negativeTTL, nil)
+			// add stores nothing once the cache is closed, and a full
+			// cache may evict the new entry straight away.
+			if ele, ok := c.cache[key]; ok {
+				kv := ele.Value.(*entry)
+				kv.negative = true
+				c.stored(kv) // record it again, now marked negative
+			}
+		}
+	}
+	return found, nil
+}
+
+// knownMissing reports whether key holds a live negative entry.
+func (c *Cache) knownMissing(key Key) bool {
+	ele, hit := c.cache[key]
+	if !hit {
+		return false
+	}
+	kv := ele.Value.(*entry)
+	return kv.negative && !c.expired(kv)
+}
+
+// call is an in-flight or completed load, as in package singleflight
+// but keyed by Key.
+type call struct {
+	wg       sync.WaitGroup
+	val      interface{}
+	err      error
+	reserved bool // made by Reserve rather than load
+}
+
+// GetOrCompute returns the value of key, calling compute to produce and
+// store it with ttl d if the key is absent or expired. Concurrent calls
+// for the same key share a single compute. A nil value is cached like
+// any other, so compute runs at most once per ttl even when it returns
+// nil; errors are returned without caching anything.
+func (c *Cache) GetOrCompute(key Key, d time.Duration, compute func() (interface{}, error)) (interface{}, error) {
+	ctx, span := c.trace(context.Background(), "kutta.GetOrCompute", key)
+	c.lock()
+	v, ok := c.get(key)
+	c.unlock()
+	span.SetHit(ok)
+	if ok {
+		span.End(nil)
+		return v, nil
+	}
+	v, err := c.load(key, func() (interface{}, error) {
+		// Another caller may have stored the key since the miss above.
+		c.mu.RLock()
+		kv := c.live(key)
+		c.mu.RUnlock()
+		if kv != nil {
+			return kv.value, nil
+		}
+		_, lspan := c.trace(ctx, "kutta.load", key)
+		v, err := compute()
+		lspan.End(err)
+		if err == nil {
+			c.AddEx(key, v, d)
+		}
+		return v, err
+	})
+	span.End(err)
+	return v, err
+}
+
+// InFlightLoads returns how many keys are being loaded right now.
+func (c *Cache) InFlightLoads() int {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	return len(c.loads)
+}
+
+// load runs fn for key unless a load for key is already in flight, in
+// which case it waits for that load and returns its result, or with
+// WithFailFastLoads returns ErrLoadInProgress at once.
+func (c *Cache) load(key Key, fn func() (interface{}, error)) (interface{}, error) {
+	c.loadMu.Lock()
+	if c.loads == nil {
+		c.loads = make(map[interface{}]*call)
+	}
+	if cl, ok := c.loads[key]; ok {
+		c.loadMu.Unlock()
+		if c.failFast {
+			return nil, ErrLoadInProgress
+		}
+		cl.wg.Wait()
+		return cl.val, cl.err
+	}
+	cl := new(call)
+	cl.wg.Add(1)
+	c.loads[key] = cl
+	c.loadMu.Unlock()
+
+	cl.val, cl.err = fn()
+	cl.wg.Done()
+
+	c.loadMu.Lock()
+	delete(c.loads, key)
+	c.loadMu.Unlock()
+	return cl.val, cl.err
+}
+
+// GetStale looks up key like Get, but with WithStaleWhileRevalidate it
+// also returns a value whose deadline has passed within the stale
+// period, reporting stale as true and starting a background reload of
+// key with the configured loader. Reloads of a key are shared with
+// concurrent GetOrCompute calls, and a failed reload leaves the stale
+// entry to expire.
+func (c *Cache) GetStale(key Key) (value interface{}, stale bool, ok bool) {
+	c.lock()
+	value, stale, ok = c.getStale(key)
+	c.unlock()
+	if stale && c.revalidate != nil {
+		go c.load(key, func() (interface{}, error) {
+			v, d, err := c.revalidate(key)
+			if err == nil {
+				c.AddEx(key, v, d)
+			}
+			return v, err
+		})
+	}
+	return
+}
+
+func (c *Cache) getStale(key Key) (value interface{}, stale bool, ok bool) {
+	ele, hit := c.element(key)
+	if !hit || ele.Value.(*entry).negative {
+		c.countMiss()
+		return
+	}
+	kv := ele.Value.(*entry)
+	if now := c.now(); c.expiredAt(kv, now) {
+		c.countExpired()
+		if c.spent(kv, now) {
+			c.expireElement(ele)
+			return
+		}
+		return kv.value, true, true
+	}
+	c.promote(ele)
+	c.countHit()
+	return kv.value, false, true
+}
+
+// Reserve claims key for a caller about to compute its value, so others
+// wait instead of duplicating the work. If key is not cached and not
+// already being loaded, Reserve returns reserved true and the caller
+// must end the reservation with Fulfill or Abandon. Otherwise it
+// returns a wait func that blocks until the value is available and
+// returns it, or reports false if the reservation is abandoned or the
+// load fails. Reservations share their waiters with GetOrCompute.
+func (c *Cache) Reserve(key Key) (reserved bool, wait func() (interface{}, bool)) {
+	c.lock()
+	v, ok := c.get(key)
+	c.unlock()
+	if ok {
+		return false, func() (interface{}, bool) { return v, true }
+	}
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	if c.loads == nil {
+		c.loads = make(map[interface{}]*call)
+	}
+	if cl, ok := c.loads[key]; ok {
+		return false, func() (interface{}, bool) {
+			cl.wg.Wait()
+			return cl.val, cl.err == nil
+		}
+	}
+	cl := &call{reserved: true}
+	cl.wg.Add(1)
+	c.loads[key] = cl
+	return true, nil
+}
+
+// Fulfill stores value under key with the ttl d and releases the
+// callers waiting on the reservation of key.
+func (c *Cache) Fulfill(key Key, value interface{}, d time.Duration) {
+	c.AddEx(key, value, d)
+	c.settle(key, value, nil)
+}
+
+// Abandon ends the reservation of key without a value; its waiters
+// report a miss.
+func (c *Cache) Abandon(key Key) {
+	c.settle(key, nil, ErrAbandoned)
+}
+
+// settle ends the reservation of key, if there is one, with the given
+// result.
+func (c *Cache) settle(key Key, value interface{}, err error) {
+	c.loadMu.Lock()
+	cl, ok := c.loads[key]
+	ok = ok && cl.reserved
+	if ok {
+		delete(c.loads, key)
+	}
+	c.loadMu.Unlock()
+	if ok {
+		cl.val, cl.err = value, err
+		cl.wg.Done()
+	}
+}
@@ -0,0 +1,402 @@
+package kutta
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	cache := New(0, time.Hour)
+	keys := []Key{1, 2, 3, 4, 5, 6, 7, 8}
+	var running, peak int32
+	err := cache.Warm(context.Background(), keys, 3, func(ctx context.Context, key Key) (interface{}, time.Duration, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return key.(int) * 10, time.Hour, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peak > 3 {
+		t.Errorf("peak concurrency = %d; want <= 3", peak)
+	}
+	for _, k := range keys {
+		if v, ok := cache.Get(k); !ok || v != k.(int)*10 {
+			t.Errorf("Get(%v) = %v, %v", k, v, ok)
+		}
+	}
+}
+
+func TestWarmError(t *testing.T) {
+	cache := New(0, time.Hour)
+	boom := errors.New("boom")
+	err := cache.Warm(context.Background(), []Key{1, 2, 3}, 1, func(ctx context.Context, key Key) (interface{}, time.Duration, error) {
+		if key == 2 {
+			return nil, 0, boom
+		}
+		return key, NoExpiration, nil
+	})
+	if err != boom {
+		t.Fatalf("Warm = %v; want %v", err, boom)
+	}
+	if _, ok := cache.Get(1); !ok {
+		t.Error("result loaded before the failure was dropped")
+	}
+	if _, ok := cache.Get(3); ok {
+		t.Error("load started after the failure")
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	cache := New(0, time.Hour, WithNegativeTTL(time.Hour))
+	cache.Add("hit", 1)
+	var calls [][]Key
+	loader := func(ctx context.Context, missing []Key) (map[Key]interface{}, error) {
+		calls = append(calls, missing)
+		return map[Key]interface{}{"load": 2}, nil
+	}
+	got, err := cache.GetBatch(context.Background(), []Key{"hit", "load", "absent", "hit"}, loader, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["hit"] != 1 || got["load"] != 2 {
+		t.Fatalf("GetBatch = %v; want hit and load", got)
+	}
+	if len(calls) != 1 || len(calls[0]) != 2 {
+		t.Fatalf("loader calls = %v; want one call with [load absent]", calls)
+	}
+	if _, ok := cache.Get("absent"); ok {
+		t.Fatal("negative entry read as a hit")
+	}
+	if _, err := cache.GetBatch(context.Background(), []Key{"load", "absent"}, loader, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("loader called again for cached and known-missing keys: %v", calls)
+	}
+	cache.Add("absent", 3)
+	if v, ok := cache.Get("absent"); !ok || v != 3 {
+		t.Fatalf("Get(absent) = %v, %v after Add; want 3, true", v, ok)
+	}
+}
+
+func TestGetBatchClosedDuringLoad(t *testing.T) {
+	cache := New(0, time.Hour, WithNegativeTTL(time.Hour))
+	loader := func(ctx context.Context, missing []Key) (map[Key]interface{}, error) {
+		cache.Close()
+		return nil, nil
+	}
+	if _, err := cache.GetBatch(context.Background(), []Key{"absent"}, loader, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBatchKeepsConcurrentStore(t *testing.T) {
+	cache := New(0, time.Hour, WithNegativeTTL(time.Hour), WithAccessCount())
+	loader := func(ctx context.Context, missing []Key) (map[Key]interface{}, error) {
+		cache.Add("raced", 1)
+		return nil, nil
+	}
+	if _, err := cache.GetBatch(context.Background(), []Key{"raced", "absent"}, loader, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := cache.Get("raced"); !ok || v != 1 {
+		t.Fatalf("Get(raced) = %v, %v; want the value stored during the load", v, ok)
+	}
+	if _, ok := cache.AccessCount("absent"); ok {
+		t.Fatal("AccessCount reported a negative entry")
+	}
+	if old, had := cache.Swap("absent", 2, time.Hour); had || old != nil {
+		t.Fatalf("Swap = %v, %v over a negative entry; want nil, false", old, had)
+	}
+}
+
+func TestGetOrComputeCachesNil(t *testing.T) {
+	cache := New(0, time.Hour)
+	var calls int32
+	compute := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := cache.GetOrCompute("k", time.Hour, compute); v != nil || err != nil {
+				t.Errorf("GetOrCompute = %v, %v; want nil, nil", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := cache.GetOrCompute("k", time.Hour, compute); v != nil || err != nil {
+		t.Fatalf("GetOrCompute = %v, %v; want nil, nil", v, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("compute called %d times; want 1", n)
+	}
+	if v, ok := cache.Get("k"); !ok || v != nil {
+		t.Fatalf("Get = %v, %v; want cached nil", v, ok)
+	}
+}
+
+func TestGetOrComputeError(t *testing.T) {
+	cache := New(0, time.Hour)
+	boom := errors.New("boom")
+	if _, err := cache.GetOrCompute("k", time.Hour, func() (interface{}, error) { return nil, boom }); err != boom {
+		t.Fatalf("GetOrCompute = %v; want %v", err, boom)
+	}
+	if _, ok := cache.Get("k"); ok {
+		t.Fatal("failed compute was cached")
+	}
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name  string
+	hit   bool
+	ended bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, key Key) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &recordedSpan{name: name}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func (s *recordedSpan) SetHit(hit bool) { s.hit = hit }
+func (s *recordedSpan) End(error)       { s.ended = true }
+
+func TestTracer(t *testing.T) {
+	tr := new(recordingTracer)
+	cache := New(0, time.Hour, WithTracer(tr))
+	compute := func() (interface{}, error) { return 1, nil }
+	cache.GetOrCompute("k", NoExpiration, compute)
+	cache.GetOrCompute("k", NoExpiration, compute)
+
+	want := []recordedSpan{
+		{name: "kutta.GetOrCompute", hit: false, ended: true},
+		{name: "kutta.load", ended: true},
+		{name: "kutta.GetOrCompute", hit: true, ended: true},
+	}
+	if len(tr.spans) != len(want) {
+		t.Fatalf("got %d spans; want %d", len(tr.spans), len(want))
+	}
+	for i, s := range tr.spans {
+		if *s != want[i] {
+			t.Errorf("span %d = %+v; want %+v", i, *s, want[i])
+		}
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	reloaded := make(chan struct{})
+	cache := New(0, time.Hour, WithStaleWhileRevalidate(time.Hour, func(key Key) (interface{}, time.Duration, error) {
+		defer close(reloaded)
+		return "fresh", time.Hour, nil
+	}))
+	cache.AddEx("k", "old", time.Hour)
+	if v, stale, ok := cache.GetStale("k"); !ok || stale || v != "old" {
+		t.Fatalf("GetStale = %v, %v, %v; want old, false, true", v, stale, ok)
+	}
+
+	cache.expireNow("k")
+	if _, ok := cache.Get("k"); ok {
+		t.Fatal("Get served an expired entry")
+	}
+	if v, stale, ok := cache.GetStale("k"); !ok || !stale || v != "old" {
+		t.Fatalf("GetStale = %v, %v, %v; want old, true, true", v, stale, ok)
+	}
+	<-reloaded
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, ok := cache.Get("k"); ok {
+			if v != "fresh" {
+				t.Fatalf("Get = %v after reload; want fresh", v)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background reload did not store a value")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, ok := cache.GetStale("missing"); ok {
+		t.Fatal("GetStale found a missing key")
+	}
+}
+
+func TestStaleRefreshKeepsEntry(t *testing.T) {
+	reloaded := make(chan struct{})
+	cache := New(0, time.Hour, WithStaleWhileRevalidate(time.Hour, func(key Key) (interface{}, time.Duration, error) {
+		defer close(reloaded)
+		return "fresh", time.Hour, nil
+	}))
+	var evicted int32
+	cache.AddExWithOnEvicted("k", "old", time.Hour, func(Key, interface{}) { atomic.AddInt32(&evicted, 1) })
+	cache.AddAlias("k", "alias")
+	cache.expireNow("k")
+	cache.GetStale("k")
+	<-reloaded
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, ok := cache.Get("alias"); ok {
+			if v != "fresh" {
+				t.Fatalf("Get(alias) = %v after reload; want fresh", v)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the alias did not survive the reload")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&evicted); n != 0 {
+		t.Fatalf("OnEvicted fired %d times for a refreshed entry", n)
+	}
+}
+
+func TestFailFastLoads(t *testing.T) {
+	cache := New(0, time.Hour, WithFailFastLoads())
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.GetOrCompute("k", time.Hour, func() (interface{}, error) {
+			close(started)
+			<-release
+			return 1, nil
+		})
+	}()
+	<-started
+	if n := cache.InFlightLoads(); n != 1 {
+		t.Fatalf("InFlightLoads = %d; want 1", n)
+	}
+	if _, err := cache.GetOrCompute("k", time.Hour, nil); err != ErrLoadInProgress {
+		t.Fatalf("GetOrCompute during a load = %v; want ErrLoadInProgress", err)
+	}
+	close(release)
+	<-done
+	if n := cache.InFlightLoads(); n != 0 {
+		t.Fatalf("InFlightLoads = %d after the load; want 0", n)
+	}
+	if v, err := cache.GetOrCompute("k", time.Hour, nil); err != nil || v != 1 {
+		t.Fatalf("GetOrCompute = %v, %v; want 1, nil", v, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	cache := New(0, time.Hour)
+	reserved, _ := cache.Reserve("k")
+	if !reserved {
+		t.Fatal("first Reserve did not reserve")
+	}
+	again, wait := cache.Reserve("k")
+	if again {
+		t.Fatal("second Reserve also reserved")
+	}
+	got := make(chan interface{})
+	go func() {
+		v, _ := wait()
+		got <- v
+	}()
+	cache.Fulfill("k", 1, time.Hour)
+	if v := <-got; v != 1 {
+		t.Fatalf("wait = %v; want 1", v)
+	}
+	if _, wait := cache.Reserve("k"); wait == nil {
+		t.Fatal("Reserve of a cached key returned no wait func")
+	} else if v, ok := wait(); !ok || v != 1 {
+		t.Fatalf("wait = %v, %v; want 1, true", v, ok)
+	}
+
+	cache.Reserve("a")
+	_, wait = cache.Reserve("a")
+	cache.Abandon("a")
+	if _, ok := wait(); ok {
+		t.Fatal("wait reported a value after Abandon")
+	}
+	if reserved, _ := cache.Reserve("a"); !reserved {
+		t.Fatal("abandoned key could not be reserved again")
+	}
+}
+
+func TestEnableBackgroundRefresh(t *testing.T) {
+	cache := New(0, time.Hour)
+	defer cache.Close()
+	cache.AddEx("soon", 0, 30*time.Millisecond)
+	cache.AddEx("later", 0, time.Hour)
+	var mu sync.Mutex
+	loads := map[Key]int{}
+	cache.EnableBackgroundRefresh(40*time.Millisecond, 2, func(key Key) (interface{}, time.Duration, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		loads[key]++
+		return loads[key], time.Hour, nil
+	})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, ok := cache.Get("soon"); ok && v != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("soon was not refreshed before expiring")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if loads["later"] != 0 {
+		t.Fatal("an entry far from expiring was refreshed")
+	}
+}
+
+func TestEnableBackgroundRefreshTinyThreshold(t *testing.T) {
+	cache := New(0, time.Hour)
+	defer cache.Close()
+	loader := func(Key) (interface{}, time.Duration, error) { return nil, time.Hour, nil }
+	for _, threshold := range []time.Duration{-time.Second, 0, time.Nanosecond} {
+		cache.EnableBackgroundRefresh(threshold, 1, loader)
+		if cache.refreshStop != nil {
+			t.Fatalf("threshold %v started a refresher", threshold)
+		}
+	}
+}
+
+func TestStaleWindowWithExpirationIndex(t *testing.T) {
+	var sweeps int64
+	loader := func(Key) (interface{}, time.Duration, error) { return nil, 0, errors.New("down") }
+	cache := New(0, time.Hour, WithExpirationIndex(), WithStaleWhileRevalidate(time.Hour, loader),
+		WithOnCleanup(func(int, int, time.Duration) { atomic.AddInt64(&sweeps, 1) }))
+	defer cache.Close()
+	cache.AddEx("k", "old", time.Hour)
+	cache.expireNow("k")
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt64(&sweeps); n > 5 {
+		t.Fatalf("%d sweeps in 50ms while an entry was stale; want the watchdog asleep", n)
+	}
+	if _, ok := cache.GetIf("k", func(interface{}) bool { return true }); ok {
+		t.Fatal("GetIf served a stale entry")
+	}
+	if _, stale, ok := cache.GetStale("k"); !ok || !stale {
+		t.Fatal("GetIf removed an entry still within its stale period")
+	}
+}
@@ -0,0 +1,83 @@
+package kutta
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// LockStats describes how long callers waited for the cache's write
+// lock. It is only collected for caches created WithLockStats.
+type LockStats struct {
+	Acquisitions uint64        // write lock acquisitions
+	Contended    uint64        // acquisitions that found the lock held
+	Wait         time.Duration // total time spent waiting in contended acquisitions
+}
+
+type lockCounters struct {
+	acquisitions uint64
+	contended    uint64
+	wait         int64
+}
+
+// lock acquires the write lock, timing the wait if lock statistics are
+// enabled.
+func (c *Cache) lock() {
+	lc := c.lockStats
+	if lc == nil {
+		c.mu.Lock()
+		return
+	}
+	atomic.AddUint64(&lc.acquisitions, 1)
+	if c.mu.TryLock() {
+		return
+	}
+	start := time.Now()
+	c.mu.Lock()
+	atomic.AddUint64(&lc.contended, 1)
+	atomic.AddInt64(&lc.wait, int64(time.Since(start)))
+}
+
+// lockContext takes the write lock like lock, giving up with ctx.Err()
+// if ctx is done first. sync.RWMutex cannot be waited on with a
+// deadline, so it polls TryLock, backing off up to a millisecond
+// between attempts.
+func (c *Cache) lockContext(ctx context.Context) error {
+	if c.mu.TryLock() {
+		if lc := c.lockStats; lc != nil {
+			atomic.AddUint64(&lc.acquisitions, 1)
+		}
+		return nil
+	}
+	start := time.Now()
+	for wait := time.Microsecond; !c.mu.TryLock(); {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+	}
+	if lc := c.lockStats; lc != nil {
+		atomic.AddUint64(&lc.acquisitions, 1)
+		atomic.AddUint64(&lc.contended, 1)
+		atomic.AddInt64(&lc.wait, int64(time.Since(start)))
+	}
+	return nil
+}
+
+// LockStats returns the write lock statistics gathered so far, or the
+// zero LockStats if the cache was not created WithLockStats.
+func (c *Cache) LockStats() LockStats {
+	lc := c.lockStats
+	if lc == nil {
+		return LockStats{}
+	}
+	return LockStats{
+		Acquisitions: atomic.LoadUint64(&lc.acquisitions),
+		Contended:    atomic.LoadUint64(&lc.contended),
+		Wait:         time.Duration(atomic.LoadInt64(&lc.wait)),
+	}
+}
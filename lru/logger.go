@@ -0,0 +1,31 @@
+package kutta
+
+// Logger receives the cache's internal diagnostics: evictions, cleanup
+// sweeps and capacity overflows at debug level, and problems the cache
+// works around, such as entries it cannot save, at info level.
+// Methods are called with the cache lock held and must not use the
+// cache.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// SetLogger directs the cache's diagnostics to l. A nil l, the default,
+// discards them.
+func (c *Cache) SetLogger(l Logger) {
+	c.lock()
+	defer c.unlock()
+	c.logger = l
+}
+
+func (c *Cache) debugf(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Debugf(format, args...)
+	}
+}
+
+func (c *Cache) infof(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Infof(format, args...)
+	}
+}
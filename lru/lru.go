@@ -2,107 +2,1300 @@ package kutta
 
 import (
 	"container/list"
-	"math/rand"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrClosed is returned by operations that report errors when they are
+// called on a cache after Close.
+var ErrClosed = errors.New("kutta: cache is closed")
+
 type Cache struct {
+	mu         sync.RWMutex
 	MaxEntries int
 	dl         *list.List
 	cache      map[interface{}]*list.Element
 	WatchDog   *watchDog
+	// peak is the largest number of entries the map has held since it
+	// was last allocated; Go maps never release their buckets.
+	peak int
+
+	evictions      uint64
+	sampleEvery    uint64
+	sampledEvicted func(key Key, value interface{})
+	onExpired      func(key Key, value interface{})
+
+	trackAccess bool
+	trackWrites bool
+
+	// expiry indexes entries with a ttl by deadline when the cache is
+	// created WithExpirationIndex; it is nil otherwise.
+	expiry *expHeap
+
+	lockStats *lockCounters
+
+	tags          map[string]*list.List // tag -> *entry, most recent first
+	maxKeysPerTag int
+
+	evictOnReplace bool
+	sampleSize     int // entries examined per cleanup, 0 for all
+	closeOnEvict   bool
+
+	logger Logger
+	tracer Tracer
+
+	sizer        func(value interface{}) int64
+	keyCost      func(key Key) int64
+	maxValueSize int64
+	bytes        int64
+	group        *CacheGroup
+
+	preserveTTL bool
+
+	version uint64 // last version handed out, see bumpVersion
+
+	sched  *Scheduler
+	closed bool
+
+	aliases map[interface{}]Key // alias -> primary key
+
+	negativeTTL time.Duration
+
+	less func(a, b *EntryView) bool
+
+	canEvict   func(key Key, value interface{}) bool
+	forceEvict bool
+
+	policy    Policy
+	insertion InsertionPolicy
+	protected int           // entries in the SLRU protected segment
+	hand      *list.Element // next entry the PolicyClock hand examines
+	// clockReads is 1 under PolicyClock, letting Get check for its
+	// shared read path without taking the lock. Accessed atomically.
+	clockReads uint32
+
+	// pending holds the callbacks due from the current write, run by
+	// unlock once the lock is released.
+	pending      []callback
+	evictTimeout time.Duration // see WithOnEvictTimeout
+
+	changeLog *changeLog // set by EnableChangeLog
+
+	sink func([]Evicted) // set by WithEvictionSink
+	sunk []Evicted       // entries removed by the current write, for sink
+
+	stats         statCounters
+	expiredAsMiss bool
+
+	coarse      bool
+	idleBackoff time.Duration // longest watchdog sleep after idle sweeps
+	minInterval time.Duration // shortest watchdog sleep, see WithAdaptiveInterval
+	interval    int64         // current watchdog sleep, accessed atomically
+	clock       int64         // coarse clock, accessed atomically
+
+	loadMu   sync.Mutex            // protects loads
+	loads    map[interface{}]*call // in-flight loads by key
+	failFast bool
+
+	debounceMu sync.Mutex                      // protects debounced
+	debounced  map[interface{}]*debouncedWrite // buffered AddDebounced writes
+
+	paused      uint32        // set by PauseCleanup, accessed atomically
+	seenExpired int           // expired entries found since the last sweep
+	maxExpired  int           // seenExpired that triggers a sweep, or 0
+	refreshStop chan struct{} // closed to stop EnableBackgroundRefresh
+
+	gen         uint64 // bumped by InvalidateAll
+	invalidated int    // entries left from earlier generations
+
+	mirror *Cache
+
+	onCleanup func(scanned, removed int, took time.Duration)
+
+	staleFor   time.Duration // how long expired entries are kept for GetStale
+	revalidate func(key Key) (interface{}, time.Duration, error)
+}
+
+// A callback is an eviction callback waiting to run.
+type callback struct {
+	fn    func(key Key, value interface{})
+	key   Key
+	value interface{}
 }
 
 type Key interface{}
 
+// NoExpiration is the ttl of entries that never expire.
+const NoExpiration time.Duration = -1
+
+// An Item is a key/value pair with its own ttl, for bulk operations,
+// following the rules of AddEx: a TTL of zero means the item is not
+// stored and a negative TTL means it does not expire.
+type Item struct {
+	Key   Key
+	Value interface{}
+	TTL   time.Duration
+}
+
 type entry struct {
 	key        Key
 	value      interface{}
-	Expiration int64
-	OnEvicted  *func(key Key, value interface{})
+	Expiration int64 // deadline in nanoseconds, or noDeadline
+	OnEvicted  func(key Key, value interface{})
+	accesses   uint64
+	writes     uint64 // overwrites, counted with WithWriteCounts
+	index      int    // position in Cache.expiry, or -1
+	tags       map[string]*list.Element
+	size       int64
+	version    uint64
+	aliases    []Key
+	negative   bool // records that a loader found no value for key
+	inserted   int64
+	stored     int64 // when value was last set
+	lastAccess int64
+	priority   int
+	protected  bool // in the SLRU protected segment
+	pinned     bool
+	referenced uint32 // PolicyClock reference bit, accessed atomically
+
+	// memo caches a transform of value, valid while version == memoVersion.
+	memo        interface{}
+	memoVersion uint64
+
+	gen uint64 // the cache's generation when the value was stored
 }
 
-func (e entry) Expired() bool {
-	if e.Expiration == 0 {
-		return false
-	}
-	return time.Now().UnixNano() > e.Expiration
+// noDeadline is the Expiration of entries that never expire. No real
+// deadline takes this value: AddUntil moves the one deadline that would
+// collide with it, the Unix epoch, a nanosecond earlier.
+const noDeadline int64 = 0
+
+// hasTTL reports whether e has a deadline.
+func (e *entry) hasTTL() bool {
+	return e.Expiration != noDeadline
 }
 
-func New(maxEntries int, cleanupInterval time.Duration) *Cache {
-	dog := &watchDog{
-		Interval: cleanupInterval,
-		stop:     make(chan bool),
+// expiredAt reports whether e's deadline has passed at now, or e was
+// invalidated by InvalidateAll.
+func (c *Cache) expiredAt(e *entry, now int64) bool {
+	return e.gen != c.gen || e.hasTTL() && now > e.Expiration
+}
+
+// expired reports whether e's deadline has passed.
+func (c *Cache) expired(e *entry) bool {
+	return c.expiredAt(e, c.now())
+}
+
+// spent reports whether e is past its deadline by more than the stale
+// period of WithStaleWhileRevalidate, so not even GetStale may serve it.
+// Entries invalidated by InvalidateAll are always spent.
+func (c *Cache) spent(e *entry, now int64) bool {
+	return e.gen != c.gen || e.hasTTL() && now > e.Expiration+int64(c.staleFor)
+}
+
+// now returns the current time in nanoseconds, read from the coarse
+// clock kept by the watchdog if the cache was created WithCoarseClock.
+func (c *Cache) now() int64 {
+	if c.coarse {
+		return atomic.LoadInt64(&c.clock)
 	}
+	return time.Now().UnixNano()
+}
+
+// New creates a cache holding at most maxEntries entries, zero meaning
+// no limit, whose watchdog goroutine removes expired entries every
+// cleanupInterval. A cleanupInterval of zero or less creates a lazy
+// cache as NewLazy does.
+func New(maxEntries int, cleanupInterval time.Duration, opts ...Option) *Cache {
 	c := &Cache{
 		MaxEntries: maxEntries,
 		dl:         list.New(),
 		cache:      make(map[interface{}]*list.Element),
-		WatchDog:   dog,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if cleanupInterval <= 0 {
+		c.coarse = false
+		return c
+	}
+	c.clock = time.Now().UnixNano()
+	dog := &watchDog{
+		Interval: cleanupInterval,
+		stop:     make(chan bool),
+		wake:     make(chan struct{}, 1),
+		sweep:    make(chan struct{}, 1),
+	}
+	c.WatchDog = dog
+	c.interval = int64(cleanupInterval)
+	atomic.AddInt64(&activeWatchDogs, 1)
 	go dog.run(c)
 	runtime.SetFinalizer(c, stopWatchDog)
 	return c
 }
 
+// activeWatchDogs counts the watchdog goroutines currently running.
+var activeWatchDogs int64
+
+// ActiveCaches returns how many caches currently have a running
+// watchdog goroutine. A count that keeps growing points to caches that
+// are neither closed nor garbage collected.
+func ActiveCaches() int {
+	return int(atomic.LoadInt64(&activeWatchDogs))
+}
+
+// NewLazy creates a cache without a watchdog goroutine or finalizer.
+// Expired entries are removed only when they are read or when
+// DeleteExpired is called, which suits short-lived caches created in
+// large numbers.
+func NewLazy(maxEntries int, opts ...Option) *Cache {
+	return New(maxEntries, 0, opts...)
+}
+
+// Add stores value under key without a deadline.
 func (c *Cache) Add(key Key, value interface{}) {
-	c.add(key, value, -1, nil)
+	c.lock()
+	defer c.unlock()
+	c.add(key, value, NoExpiration, nil)
 }
 
+// AddEx stores value under key with the ttl d. A positive d sets the
+// deadline d from now, a negative d, such as NoExpiration, stores the
+// value without one, and a zero d means the value expires immediately:
+// it is not stored and any previous value of key is removed. Every
+// method taking a ttl follows the same rules.
 func (c *Cache) AddEx(key Key, value interface{}, d time.Duration) {
+	c.lock()
+	defer c.unlock()
 	c.add(key, value, d, nil)
 }
 
-func (c *Cache) AddExWithOnEvicted(key Key, value interface{}, d time.Duration, onEvicted *func(key Key, value interface{})) {
+// AddExWithOnEvicted is like AddEx but calls onEvicted when the entry
+// leaves the cache. Eviction callbacks run after the cache lock has been
+// released, so they may use the cache, including adding the evicted key
+// back; by then another goroutine may already have changed it.
+func (c *Cache) AddExWithOnEvicted(key Key, value interface{}, d time.Duration, onEvicted func(key Key, value interface{})) {
+	c.lock()
+	defer c.unlock()
 	c.add(key, value, d, onEvicted)
 }
 
-func (c *Cache) add(key Key, value interface{}, d time.Duration, onEvicted *func(key Key, value interface{})) {
-	var e int64
+// AddExWithOnEvictedPtr is AddExWithOnEvicted with the callback passed
+// by pointer, as AddExWithOnEvicted used to take it. A nil pointer means
+// no callback.
+//
+// Deprecated: pass the func itself to AddExWithOnEvicted; code written
+// as AddExWithOnEvicted(k, v, d, &fn) becomes AddExWithOnEvicted(k, v,
+// d, fn).
+func (c *Cache) AddExWithOnEvictedPtr(key Key, value interface{}, d time.Duration, onEvicted *func(key Key, value interface{})) {
+	var fn func(key Key, value interface{})
+	if onEvicted != nil {
+		fn = *onEvicted
+	}
+	c.AddExWithOnEvicted(key, value, d, fn)
+}
+
+// AddReturning is like AddEx but reports whether making room for the
+// entry evicted another one, and if so which key.
+func (c *Cache) AddReturning(key Key, value interface{}, d time.Duration) (evicted bool, evictedKey Key) {
+	c.lock()
+	defer c.unlock()
+	if kv := c.add(key, value, d, nil); kv != nil {
+		return true, kv.key
+	}
+	return false, nil
+}
+
+// AddAll adds every item under a single lock acquisition, each with its
+// own ttl. Items are added in order, so if the batch exceeds MaxEntries
+// the earliest ones are evicted first.
+func (c *Cache) AddAll(items []Item) {
+	c.lock()
+	defer c.unlock()
+	for _, it := range items {
+		c.add(it.Key, it.Value, it.TTL, nil)
+	}
+}
+
+// A LoadPolicy tells LoadMap what to do with a map larger than
+// MaxEntries.
+type LoadPolicy int
+
+const (
+	// LoadFail makes LoadMap return ErrTooLarge and load nothing.
+	LoadFail LoadPolicy = iota
+	// LoadTruncate loads only MaxEntries of the map's entries; which
+	// ones is unspecified, as map iteration order is.
+	LoadTruncate
+	// LoadGrow raises MaxEntries to the size of the map.
+	LoadGrow
+)
+
+// ErrTooLarge is returned by LoadMap under LoadFail when the map holds
+// more entries than the cache may.
+var ErrTooLarge = errors.New("kutta: more entries than the cache can hold")
+
+// LoadMap stores every entry of m with the ttl d under one lock
+// acquisition, handling a map larger than MaxEntries as policy says.
+// Room is made by evicting the least recently used entries whose keys
+// are not in m first, so loading never evicts entries of m itself.
+// LoadMap returns ErrClosed if the cache is closed.
+func (c *Cache) LoadMap(m map[Key]interface{}, d time.Duration, policy LoadPolicy) error {
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.MaxEntries != 0 && len(m) > c.MaxEntries {
+		switch policy {
+		case LoadFail:
+			return ErrTooLarge
+		case LoadTruncate:
+			m = truncate(m, c.MaxEntries)
+		case LoadGrow:
+			c.MaxEntries = len(m)
+		}
+	}
+	if c.MaxEntries != 0 {
+		c.makeRoom(m)
+	}
+	for key, value := range m {
+		c.add(key, value, d, nil)
+	}
+	return nil
+}
+
+// truncate returns n of the entries of m.
+func truncate(m map[Key]interface{}, n int) map[Key]interface{} {
+	t := make(map[Key]interface{}, n)
+	for key, value := range m {
+		if len(t) == n {
+			break
+		}
+		t[key] = value
+	}
+	return t
+}
+
+// makeRoom evicts entries whose keys are not in m, oldest first, until
+// the entries of m fit within MaxEntries alongside what remains.
+func (c *Cache) makeRoom(m map[Key]interface{}) {
+	need := c.len() + len(m)
+	for key := range m {
+		if _, ok := c.cache[key]; ok {
+			need--
+		}
+	}
+	for ele := c.dl.Back(); ele != nil && need > c.MaxEntries; {
+		prev := ele.Prev()
+		if kv := ele.Value.(*entry); !kv.pinned {
+			if _, ok := m[kv.key]; !ok {
+				c.drop(ele, ReasonCapacity)
+				need--
+			}
+		}
+		ele = prev
+	}
+}
+
+// SeedFrom copies the live entries of other into the cache with their
+// remaining ttls, so a new cache can start warm from an old one. other
+// is only read, under its read lock, and its recency order is kept:
+// its most recently used entry is also the newest here. The entries are
+// stored as by AddUntil, subject to the cache's own capacity, options
+// and callbacks, and keep none of other's per-entry callbacks.
+func (c *Cache) SeedFrom(other *Cache) {
+	if other == c {
+		return
+	}
+	type seed struct {
+		key   Key
+		value interface{}
+		e     int64
+	}
+	other.mu.RLock()
+	var seeds []seed
+	if other.cache != nil {
+		now := other.now()
+		seeds = make([]seed, 0, other.dl.Len())
+		for ele := other.dl.Back(); ele != nil; ele = ele.Prev() {
+			if kv := ele.Value.(*entry); !kv.negative && !other.expiredAt(kv, now) {
+				seeds = append(seeds, seed{kv.key, kv.value, kv.Expiration})
+			}
+		}
+	}
+	other.mu.RUnlock()
+
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	for _, s := range seeds {
+		c.putAt(s.key, s.value, s.e, now, nil, c.sizeOf(s.value))
+	}
+}
+
+// ReplaceAll atomically replaces the contents of the cache with items,
+// so readers see either the old or the new entries and never an empty
+// cache in between. The new list and map are built before the lock is
+// taken. Old entries whose keys are not among items are evicted,
+// firing their OnEvicted; entries for retained keys keep their
+// callback, which WithEvictOnReplace calls with the replaced value. If
+// items exceed MaxEntries only the last ones are kept.
+func (c *Cache) ReplaceAll(items []Item) {
+	dl := list.New()
+	cache := make(map[interface{}]*list.Element, len(items))
+	now := c.now()
+	for _, it := range items {
+		e := noDeadline
+		switch {
+		case it.TTL > 0:
+			e = now + int64(it.TTL)
+		case it.TTL == 0:
+			continue
+		}
+		if ele, ok := cache[it.Key]; ok {
+			dl.Remove(ele)
+		}
+		cache[it.Key] = dl.PushFront(&entry{key: it.Key, value: it.Value, Expiration: e, index: -1,
+			size: c.sizeOf(it.Value) + c.keySize(it.Key), inserted: now, lastAccess: now})
+	}
+
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return
+	}
+	for ele := dl.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		kv.gen = c.gen
+		c.bumpVersion(kv)
+	}
+	// Trimming is by position, not the eviction comparator, since the new
+	// entries carry no history yet.
+	for c.MaxEntries != 0 && dl.Len() > c.MaxEntries {
+		delete(cache, dl.Remove(dl.Back()).(*entry).key)
+	}
+	for key, ele := range c.cache {
+		if next, ok := cache[key]; ok {
+			prev, kv := ele.Value.(*entry), next.Value.(*entry)
+			if c.evictOnReplace {
+				c.release(prev)
+			}
+			kv.OnEvicted = prev.OnEvicted
+			kv.aliases = prev.aliases
+			c.retag(prev, kv)
+			continue
+		}
+		c.discard(ele, now)
+	}
+	var bytes int64
+	for ele := dl.Front(); ele != nil; ele = ele.Next() {
+		bytes += ele.Value.(*entry).size
+	}
+	c.addBytes(bytes - c.bytes)
+	c.dl = dl
+	c.cache = cache
+	c.protected = 0
+	c.hand = nil
+	c.invalidated = 0
+	if len(cache) > c.peak {
+		c.peak = len(cache)
+	}
+	if c.expiry != nil {
+		c.expiry = new(expHeap)
+		for ele := dl.Front(); ele != nil; ele = ele.Next() {
+			c.indexExpiration(ele.Value.(*entry))
+		}
+	}
+	if c.changeLog != nil || c.mirror != nil {
+		c.logOp(changeClear)
+		for ele := dl.Back(); ele != nil; ele = ele.Prev() {
+			c.stored(ele.Value.(*entry))
+		}
+	}
+}
+
+// Rename moves the entry stored under oldKey to newKey, keeping its
+// value, deadline, version and recency. Any entry under newKey is
+// removed first, firing its OnEvicted, or the SetOnExpired callback
+// if it has expired. Aliases of the entry follow it. It reports false,
+// changing nothing, if oldKey is absent or expired.
+func (c *Cache) Rename(oldKey, newKey Key) bool {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.cache[oldKey]
+	if !hit {
+		return false
+	}
+	kv := ele.Value.(*entry)
+	if kv.negative || c.expired(kv) {
+		return false
+	}
+	if oldKey == newKey {
+		return true
+	}
+	if prev, hit := c.cache[newKey]; hit {
+		c.discard(prev, c.now())
+	}
+	if c.mirror != nil {
+		c.mirrorRemove(oldKey)
+	}
+	c.logRemove(oldKey)
+	delete(c.cache, oldKey)
+	c.cache[newKey] = ele
+	size := kv.size - c.keySize(oldKey)
+	kv.key = newKey
+	c.setSize(kv, size)
+	for _, a := range kv.aliases {
+		c.aliases[a] = newKey
+	}
+	c.stored(kv)
+	return true
+}
+
+// Swap stores value under key with the ttl d and returns the value it
+// replaced. An expired previous entry, or a negative one recorded by
+// GetBatch, is reported as absent.
+func (c *Cache) Swap(key Key, value interface{}, d time.Duration) (old interface{}, had bool) {
+	c.lock()
+	defer c.unlock()
+	if ele, hit := c.cache[key]; hit {
+		switch kv, now := ele.Value.(*entry), c.now(); {
+		case c.spent(kv, now):
+			c.expireElement(ele)
+		case !kv.negative && !c.expiredAt(kv, now):
+			old, had = kv.value, true
+		}
+	}
+	c.add(key, value, d, nil)
+	return
+}
+
+// AddUntil stores value under key to expire at deadline, which is kept
+// as given rather than converted to a ttl. A deadline that has already
+// passed removes key, as a zero ttl does with AddEx.
+func (c *Cache) AddUntil(key Key, value interface{}, deadline time.Time) {
+	c.lock()
+	defer c.unlock()
+	e := deadline.UnixNano()
+	if e == noDeadline {
+		e--
+	}
+	c.putAt(key, value, e, c.now(), nil, c.sizeOf(value))
+}
+
+// AddAligned stores value under key to expire at the next multiple of
+// period, counted from the zero time, so every entry added within one
+// period expires together, e.g. on the minute for a period of
+// time.Minute. Boundaries are computed from the wall clock when the
+// entry is added and are unaffected by time zones and daylight saving.
+// period must be positive.
+func (c *Cache) AddAligned(key Key, value interface{}, period time.Duration) {
+	c.lock()
+	defer c.unlock()
+	now := c.now()
+	deadline := time.Unix(0, now).Truncate(period).Add(period)
+	c.putAt(key, value, deadline.UnixNano(), now, nil, c.sizeOf(value))
+}
+
+// AddOrGet stores value under key with the ttl d unless key already
+// holds a live value, which it returns without overwriting. inserted
+// reports which happened; when it is true, actual is value.
+func (c *Cache) AddOrGet(key Key, value interface{}, d time.Duration) (actual interface{}, inserted bool) {
+	c.lock()
+	defer c.unlock()
+	if ele, hit := c.element(key); hit {
+		kv := ele.Value.(*entry)
+		if !kv.negative && !c.expired(kv) {
+			c.promote(ele)
+			return kv.value, false
+		}
+		key = kv.key
+	}
+	c.add(key, value, d, nil)
+	return value, true
+}
+
+// IncrementFloat adds delta to the float64 stored under key and returns
+// the new total, keeping the entry's deadline. If key is absent or
+// expired, or holds a value that is not a float64, it stores delta with
+// the ttl d instead, replacing the value. Values incremented this way
+// should only be stored as float64.
+func (c *Cache) IncrementFloat(key Key, delta float64, d time.Duration) float64 {
+	c.lock()
+	defer c.unlock()
+	if ele, hit := c.cache[key]; hit {
+		kv := ele.Value.(*entry)
+		if f, ok := kv.value.(float64); ok && !kv.negative && !c.expired(kv) {
+			if c.evictOnReplace {
+				c.release(kv)
+			}
+			kv.value = f + delta
+			c.dl.MoveToFront(ele)
+			c.bumpVersion(kv)
+			c.setSize(kv, c.sizeOf(kv.value))
+			c.stored(kv)
+			return f + delta
+		}
+	}
+	c.add(key, delta, d, nil)
+	return delta
+}
+
+// Modify atomically replaces the value of key with the result of fn,
+// which is called under the write lock with the current value and
+// whether key held a live one. If fn reports keep as false the entry is
+// removed; otherwise the value fn returns is stored. A value that was
+// absent is stored with the ttl d; an existing entry keeps its deadline
+// unless resetTTL is true, in which case it gets the ttl d as with
+// AddEx. fn must not use the cache.
+func (c *Cache) Modify(key Key, d time.Duration, resetTTL bool, fn func(old interface{}, found bool) (value interface{}, keep bool)) {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	var kv *entry
+	if hit {
+		kv = ele.Value.(*entry)
+		key = kv.key
+		if kv.negative || c.expired(kv) {
+			kv = nil
+		}
+	}
+	var old interface{}
+	if kv != nil {
+		old = kv.value
+	}
+	value, keep := fn(old, kv != nil)
+	switch {
+	case !keep || kv != nil && resetTTL && d == 0:
+		if hit {
+			c.discard(ele, c.now())
+		}
+	case kv == nil:
+		c.add(key, value, d, nil)
+	default:
+		size := c.sizeOf(value)
+		if c.maxValueSize > 0 && size > c.maxValueSize {
+			c.infof("kutta: rejecting %d byte value for %v, limit is %d", size, key, c.maxValueSize)
+			c.discard(ele, c.now())
+			return
+		}
+		if c.evictOnReplace {
+			c.release(kv)
+		}
+		kv.value = value
+		c.dl.MoveToFront(ele)
+		c.bumpVersion(kv)
+		c.setSize(kv, size)
+		if resetTTL {
+			c.touch(kv, d)
+		}
+		c.stored(kv)
+	}
+}
+
+// add stores value under key and reports the entry, if any, evicted to
+// make room for it.
+func (c *Cache) add(key Key, value interface{}, d time.Duration, onEvicted func(key Key, value interface{})) (evicted *entry) {
+	evicted, _ = c.put(key, value, d, onEvicted, c.sizeOf(value))
+	return evicted
+}
+
+// put is add with the entry's size given. It reports false, storing
+// nothing and dropping any previous value of key, if size exceeds the
+// limit set by WithMaxValueSize. A ttl of zero also drops the previous
+// value without storing the new one, since it would expire at once.
+func (c *Cache) put(key Key, value interface{}, d time.Duration, onEvicted func(key Key, value interface{}), size int64) (evicted *entry, ok bool) {
+	now := c.now()
+	e := noDeadline
+	switch {
+	case d > 0:
+		e = now + int64(d)
+	case d == 0:
+		e = now
+	}
+	return c.putAt(key, value, e, now, onEvicted, size)
+}
+
+// putAt is put with the deadline e given as a time in nanoseconds, or
+// noDeadline. A deadline that is not after now drops the entry as a
+// zero ttl does.
+func (c *Cache) putAt(key Key, value interface{}, e, now int64, onEvicted func(key Key, value interface{}), size int64) (evicted *entry, ok bool) {
+	if c.closed {
+		return nil, false
+	}
+	if c.maxValueSize > 0 && size > c.maxValueSize {
+		c.infof("kutta: rejecting %d byte value for %v, limit is %d", size, key, c.maxValueSize)
+		if ele, hit := c.cache[key]; hit {
+			c.discard(ele, now)
+		}
+		return nil, false
+	}
+	if e != noDeadline && e <= now {
+		if ele, hit := c.cache[key]; hit {
+			c.discard(ele, now)
+		}
+		return nil, true
+	}
 	if c.cache == nil {
 		c.cache = make(map[interface{}]*list.Element)
 		c.dl = list.New()
 	}
-	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
+	// An entry past its deadline and stale period is not replaced but
+	// expires, and a new one is stored in its place. A stale entry still
+	// being refreshed, and one invalidated by InvalidateAll, is reused,
+	// keeping its aliases, tags, pin and OnEvicted.
+	if ee, ok := c.cache[key]; ok {
+		if kv := ee.Value.(*entry); kv.gen == c.gen && c.spent(kv, now) {
+			c.expireElement(ee)
+		}
 	}
 	if ee, ok := c.cache[key]; ok {
 		c.dl.MoveToFront(ee)
 		item := ee.Value.(*entry)
+		if c.evictOnReplace {
+			c.release(item)
+		}
 		item.value = value
-		item.Expiration = e
-		return
+		item.negative = false
+		if c.trackWrites {
+			item.writes++
+		}
+		if item.gen != c.gen {
+			item.gen = c.gen
+			c.invalidated--
+		}
+		c.bumpVersion(item)
+		if e != noDeadline || !c.preserveTTL {
+			item.Expiration = e
+			c.indexExpiration(item)
+		}
+		c.setSize(item, size)
+		c.stored(item)
+		return nil, true
+	}
+	if back := c.dl.Back(); c.maxExpired > 0 && back != nil && c.expiredAt(back.Value.(*entry), now) {
+		c.noteExpired()
+	}
+	item := &entry{key: key, value: value, Expiration: e, OnEvicted: onEvicted, index: -1,
+		inserted: now, lastAccess: now, gen: c.gen}
+	c.bumpVersion(item)
+	var ele *list.Element
+	if c.insertion == InsertProbation {
+		// Make room first, or the newcomer would be its own victim.
+		if c.MaxEntries != 0 && c.dl.Len() >= c.MaxEntries {
+			evicted = c.evict()
+		}
+		ele = c.dl.PushBack(item)
+	} else {
+		ele = c.dl.PushFront(item)
 	}
-	ele := c.dl.PushFront(&entry{key, value, e, onEvicted})
 	c.cache[key] = ele
+	c.setSize(item, size)
+	c.indexExpiration(item)
+	c.stored(item)
+	if len(c.cache) > c.peak {
+		c.peak = len(c.cache)
+	}
 	if c.MaxEntries != 0 && c.dl.Len() > c.MaxEntries {
-		c.RemoveOldest()
+		c.debugf("kutta: %d entries exceed capacity %d, evicting", c.dl.Len(), c.MaxEntries)
+		return c.evict(), true
+	}
+	return evicted, true
+}
+
+// stored records that kv now holds its current value and deadline, in
+// the change log and on the mirror. Every successful store, including
+// in-place updates, goes through it.
+func (c *Cache) stored(kv *entry) {
+	c.logPut(kv)
+	if c.mirror != nil {
+		c.mirrorPut(kv)
+	}
+}
+
+// bumpVersion gives e a version newer than any other in the cache and
+// records when its value was set. The counter is cache wide so a key
+// that is removed and added again never reuses a version.
+func (c *Cache) bumpVersion(e *entry) {
+	c.version++
+	e.version = c.version
+	e.stored = c.now()
+}
+
+// indexExpiration records a change to e's deadline in the expiration
+// index and wakes the watchdog if e is now the first entry due.
+func (c *Cache) indexExpiration(e *entry) {
+	if c.expiry == nil {
+		return
+	}
+	c.expiry.sync(e)
+	if e.index == 0 {
+		c.WatchDog.poke()
 	}
 }
 
 func (c *Cache) Get(key Key) (value interface{}, ok bool) {
+	if atomic.LoadUint32(&c.clockReads) != 0 {
+		if value, ok = c.getShared(key); ok {
+			return
+		}
+	}
+	c.lock()
+	defer c.unlock()
+	return c.get(key)
+}
+
+// getShared serves a PolicyClock hit under the read lock, which only
+// needs to set the entry's reference bit. It reports false for anything
+// needing the write lock, leaving the read to get.
+func (c *Cache) getShared(key Key) (value interface{}, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.policy != PolicyClock || c.less != nil || c.trackAccess {
+		return nil, false
+	}
+	ele, hit := c.element(key)
+	if !hit {
+		return nil, false
+	}
+	kv := ele.Value.(*entry)
+	if kv.negative || c.expired(kv) {
+		return nil, false
+	}
+	atomic.StoreUint32(&kv.referenced, 1)
+	c.countHit()
+	return kv.value, true
+}
+
+// TryGet is like Get but returns ctx.Err() if ctx is done before the
+// cache lock can be taken, so a caller is not stalled indefinitely by a
+// contended cache.
+func (c *Cache) TryGet(ctx context.Context, key Key) (value interface{}, ok bool, err error) {
+	if err = c.lockContext(ctx); err != nil {
+		return nil, false, err
+	}
+	defer c.unlock()
+	value, ok = c.get(key)
+	return
+}
+
+func (c *Cache) get(key Key) (value interface{}, ok bool) {
 	if c.cache == nil {
+		c.countMiss()
 		return
 	}
-	if ele, hit := c.cache[key]; hit {
+	if ele, hit := c.element(key); hit {
 		v := ele.Value.(*entry)
-		if v.Expired() {
-			c.removeElement(ele)
-			// double check func evicted reload cache
-			if ele, hit := c.cache[key]; hit {
-				v := ele.Value.(*entry)
-				return v.value, true
+		if c.expired(v) {
+			if c.spent(v, c.now()) {
+				c.expireElement(ele)
 			}
+			c.countExpired()
 			return
 		}
-		c.dl.MoveToFront(ele)
+		if v.negative {
+			c.countMiss()
+			return
+		}
+		c.promote(ele)
+		c.countHit()
 		return v.value, true
 	}
+	c.countMiss()
 	return
 }
 
+// element looks up key, falling back to the entry key is an alias of.
+func (c *Cache) element(key Key) (*list.Element, bool) {
+	if ele, hit := c.cache[key]; hit {
+		return ele, true
+	}
+	if primary, ok := c.aliases[key]; ok {
+		return c.cache[primary], true
+	}
+	return nil, false
+}
+
+// AddAlias makes Get(alias) return the entry stored under primary, with
+// the same ttl and recency. The alias is dropped when the primary entry
+// leaves the cache; a real entry stored under alias takes precedence.
+// Other reads and in-place updates, such as Modify, AddOrGet,
+// CompareVersionAndSwap, Pin and SetPriority, also act on the primary
+// entry when given alias. It reports false if primary is not in the
+// cache.
+func (c *Cache) AddAlias(primary Key, alias Key) bool {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.cache[primary]
+	if !hit {
+		return false
+	}
+	if prev, ok := c.aliases[alias]; ok {
+		if prev == primary {
+			return true
+		}
+		c.unalias(alias)
+	}
+	if c.aliases == nil {
+		c.aliases = make(map[interface{}]Key)
+	}
+	c.aliases[alias] = primary
+	kv := ele.Value.(*entry)
+	kv.aliases = append(kv.aliases, alias)
+	return true
+}
+
+// RemoveAlias drops alias without affecting the entry it points to.
+func (c *Cache) RemoveAlias(alias Key) {
+	c.lock()
+	defer c.unlock()
+	c.unalias(alias)
+}
+
+func (c *Cache) unalias(alias Key) {
+	primary, ok := c.aliases[alias]
+	if !ok {
+		return
+	}
+	delete(c.aliases, alias)
+	kv := c.cache[primary].Value.(*entry)
+	for i, a := range kv.aliases {
+		if a == alias {
+			kv.aliases = append(kv.aliases[:i], kv.aliases[i+1:]...)
+			break
+		}
+	}
+}
+
+// live returns the unexpired entry stored under key, or nil. It only
+// reads, so the read lock suffices.
+func (c *Cache) live(key Key) *entry {
+	ele, hit := c.element(key)
+	if !hit {
+		return nil
+	}
+	if kv := ele.Value.(*entry); !kv.negative && !c.expired(kv) {
+		return kv
+	}
+	return nil
+}
+
+// ContainsAll reports whether every key in keys has a live, unexpired
+// entry. It checks under one read lock and promotes nothing.
+func (c *Cache) ContainsAll(keys []Key) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range keys {
+		if c.live(key) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainsAny reports whether at least one key in keys has a live,
+// unexpired entry. Like ContainsAll, it promotes nothing.
+func (c *Cache) ContainsAny(keys []Key) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, key := range keys {
+		if c.live(key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// promote records a read of ele.
+func (c *Cache) promote(ele *list.Element) {
+	if c.policy == PolicyClock {
+		atomic.StoreUint32(&ele.Value.(*entry).referenced, 1)
+	} else {
+		c.dl.MoveToFront(ele)
+	}
+	if c.policy == PolicySLRU {
+		c.protect(ele.Value.(*entry))
+	}
+	if c.trackAccess {
+		kv := ele.Value.(*entry)
+		kv.accesses++
+		kv.lastAccess = c.now()
+	}
+}
+
+// GetIf is like Get but only reports a hit if valid returns true for
+// the cached value. An entry that fails valid is evicted, so the next
+// caller sees a plain miss; an alias key evicts its primary entry.
+// valid is called with the lock held and must not use the cache.
+func (c *Cache) GetIf(key Key, valid func(value interface{}) bool) (interface{}, bool) {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if !hit {
+		c.countMiss()
+		return nil, false
+	}
+	v := ele.Value.(*entry)
+	now := c.now()
+	if c.expiredAt(v, now) {
+		if c.spent(v, now) {
+			c.expireElement(ele)
+		}
+		c.countExpired()
+		return nil, false
+	}
+	if v.negative {
+		c.countMiss()
+		return nil, false
+	}
+	if !valid(v.value) {
+		c.discard(ele, now)
+		c.countMiss()
+		return nil, false
+	}
+	c.promote(ele)
+	c.countHit()
+	return v.value, true
+}
+
+// GetFresh is like Get but only reports a hit if the value was stored
+// at most maxAge ago, whatever its ttl. Older values are left in place
+// for readers with a looser bound.
+func (c *Cache) GetFresh(key Key, maxAge time.Duration) (interface{}, bool) {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if hit && c.now()-ele.Value.(*entry).stored > int64(maxAge) {
+		c.countMiss()
+		return nil, false
+	}
+	return c.get(key)
+}
+
+// GetAndTouch is like Get but also resets the deadline of a live entry
+// to d from now, as add would for a new ttl d, in the same locked
+// operation. With a zero d the value is returned and the entry removed.
+func (c *Cache) GetAndTouch(key Key, d time.Duration) (value interface{}, ok bool) {
+	c.lock()
+	defer c.unlock()
+	if value, ok = c.get(key); ok {
+		ele, _ := c.element(key)
+		if d == 0 {
+			c.discard(ele, c.now())
+		} else {
+			c.touch(ele.Value.(*entry), d)
+			c.stored(ele.Value.(*entry))
+		}
+	}
+	return
+}
+
+// touch sets e's deadline to d from now, or clears it for a negative d.
+func (c *Cache) touch(e *entry, d time.Duration) {
+	e.Expiration = noDeadline
+	if d > 0 {
+		e.Expiration = c.now() + int64(d)
+	}
+	c.indexExpiration(e)
+}
+
+// GetWithDepth is like Get but also reports how many entries preceded
+// key in the recency order before the read promoted it, zero meaning it
+// was already the most recently used, for measuring how far back hits
+// reach. Finding the depth walks the list, taking O(n) time. The depth
+// is -1 when ok is false.
+func (c *Cache) GetWithDepth(key Key) (value interface{}, depth int, ok bool) {
+	c.lock()
+	defer c.unlock()
+	if ele, hit := c.element(key); hit {
+		for e := c.dl.Front(); e != ele; e = e.Next() {
+			depth++
+		}
+	}
+	if value, ok = c.get(key); !ok {
+		return nil, -1, false
+	}
+	return value, depth, true
+}
+
+// GetWithVersion is like Get but also returns the entry's version,
+// which changes every time its value does.
+func (c *Cache) GetWithVersion(key Key) (value interface{}, version uint64, ok bool) {
+	c.lock()
+	defer c.unlock()
+	if value, ok = c.get(key); ok {
+		ele, _ := c.element(key)
+		version = ele.Value.(*entry).version
+	}
+	return
+}
+
+// A Result describes a key as found by Lookup.
+type Result struct {
+	Value interface{}
+	// Found reports whether the key holds a live value. When it is
+	// false, Value is nil.
+	Found bool
+	// Expired reports whether the key holds a value past its deadline.
+	Expired bool
+	// ExpiresAt is the entry's deadline, zero if it does not expire or
+	// no entry was found.
+	ExpiresAt time.Time
+}
+
+// Lookup reads key like Get, promoting and counting a hit, and reports
+// everything known about it in one locked pass.
+func (c *Cache) Lookup(key Key) Result {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if !hit {
+		c.countMiss()
+		return Result{}
+	}
+	kv := ele.Value.(*entry)
+	var r Result
+	if kv.hasTTL() {
+		r.ExpiresAt = time.Unix(0, kv.Expiration)
+	}
+	now := c.now()
+	switch {
+	case c.expiredAt(kv, now):
+		r.Expired = true
+		if c.spent(kv, now) {
+			c.expireElement(ele)
+		}
+		c.countExpired()
+	case kv.negative:
+		c.countMiss()
+	default:
+		r.Value, r.Found = kv.value, true
+		c.promote(ele)
+		c.countHit()
+	}
+	return r
+}
+
+// CompareVersionAndSwap replaces the value of key with newValue, keeping
+// its ttl, only if the entry is live and still at expectedVersion. It
+// reports whether the value was replaced.
+func (c *Cache) CompareVersionAndSwap(key Key, expectedVersion uint64, newValue interface{}) bool {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if !hit {
+		return false
+	}
+	kv := ele.Value.(*entry)
+	if c.expired(kv) || kv.version != expectedVersion {
+		return false
+	}
+	if c.evictOnReplace {
+		c.release(kv)
+	}
+	kv.value = newValue
+	c.bumpVersion(kv)
+	c.setSize(kv, c.sizeOf(newValue))
+	c.dl.MoveToFront(ele)
+	c.stored(kv)
+	return true
+}
+
+// GetTransformed is like Get but returns transform applied to the
+// cached value, leaving the stored value as is. transform runs without
+// the cache lock held and may be called concurrently for the same
+// value, so it must be pure or do its own synchronization, and must not
+// modify the stored value.
+func (c *Cache) GetTransformed(key Key, transform func(stored interface{}) interface{}) (interface{}, bool) {
+	v, ok := c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return transform(v), true
+}
+
+// GetTransformedMemo is like GetTransformed but remembers the result on
+// the entry and returns it on later calls until the value is replaced.
+// Only one transform is remembered per entry, so every caller should
+// pass the same transform for a given key.
+func (c *Cache) GetTransformedMemo(key Key, transform func(stored interface{}) interface{}) (interface{}, bool) {
+	v, version, memo, memoized, ok := c.getMemo(key)
+	if !ok {
+		return nil, false
+	}
+	if memoized {
+		return memo, true
+	}
+	t := transform(v)
+	c.lock()
+	defer c.unlock()
+	if ele, hit := c.element(key); hit {
+		if kv := ele.Value.(*entry); kv.version == version {
+			kv.memo, kv.memoVersion = t, version
+		}
+	}
+	return t, true
+}
+
+// getMemo is Get also returning the entry's version and, if memoized is
+// true, the transform remembered for that version.
+func (c *Cache) getMemo(key Key) (value interface{}, version uint64, memo interface{}, memoized, ok bool) {
+	c.lock()
+	defer c.unlock()
+	if value, ok = c.get(key); !ok {
+		return
+	}
+	ele, _ := c.element(key)
+	kv := ele.Value.(*entry)
+	return value, kv.version, kv.memo, kv.memoVersion == kv.version, true
+}
+
+// AccessCount returns how many times key, or the entry it aliases, has
+// been read by Get. It reports false if the key is absent, expired, or
+// the cache was not created with WithAccessCount.
+func (c *Cache) AccessCount(key Key) (uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.trackAccess || c.cache == nil {
+		return 0, false
+	}
+	if ele, hit := c.element(key); hit {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expired(kv) {
+			return kv.accesses, true
+		}
+	}
+	return 0, false
+}
+
+// LastAccess returns when key was last read by Get, or when it was
+// added if it has not been read since. Like AccessCount, it reports
+// false if the key is absent, expired, or the cache was not created
+// with WithAccessCount.
+func (c *Cache) LastAccess(key Key) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.trackAccess {
+		return time.Time{}, false
+	}
+	if kv := c.live(key); kv != nil {
+		return time.Unix(0, kv.lastAccess), true
+	}
+	return time.Time{}, false
+}
+
 func (c *Cache) Remove(key Key) {
+	c.lock()
+	defer c.unlock()
+	if c.mirror != nil {
+		c.mirrorRemove(key)
+	}
 	if c.cache == nil {
 		return
 	}
@@ -112,73 +1305,701 @@ func (c *Cache) Remove(key Key) {
 }
 
 func (c *Cache) RemoveOldest() {
+	c.lock()
+	defer c.unlock()
+	c.removeOldest()
+}
+
+func (c *Cache) removeOldest() *entry {
 	if c.cache == nil {
-		return
+		return nil
 	}
-	ele := c.dl.Back()
+	ele := c.oldestUnpinned()
 	if ele != nil {
 		c.removeElement(ele)
+		return ele.Value.(*entry)
 	}
+	return nil
 }
 
+// removeElement removes e, which was removed or replaced.
 func (c *Cache) removeElement(e *list.Element) {
+	c.drop(e, ReasonRemoved)
+}
+
+// discard removes e for a write, as expired if its deadline has passed,
+// and removes its key from the mirror. Every removal a write asks for,
+// rather than an eviction or expiry, goes through it.
+func (c *Cache) discard(e *list.Element, now int64) {
+	if c.expiredAt(e.Value.(*entry), now) {
+		c.expireElement(e)
+	} else {
+		c.removeElement(e)
+	}
+	if c.mirror != nil {
+		c.mirrorRemove(e.Value.(*entry).key)
+	}
+}
+
+// expireElement removes e, which has expired or been invalidated.
+func (c *Cache) expireElement(e *list.Element) {
+	reason := ReasonExpired
+	if e.Value.(*entry).gen != c.gen {
+		reason = ReasonRemoved
+	}
+	c.drop(e, reason)
+}
+
+func (c *Cache) drop(e *list.Element, reason EvictionReason) {
+	if c.hand == e {
+		c.hand = e.Prev()
+	}
 	c.dl.Remove(e)
 	kv := e.Value.(*entry)
 	delete(c.cache, kv.key)
-	if kv != nil && kv.OnEvicted != nil {
-		onEvicted := *kv.OnEvicted
-		onEvicted(kv.key, kv.value)
+	if c.expiry != nil {
+		c.expiry.remove(kv)
+	}
+	if kv.tags != nil {
+		c.untag(kv)
+	}
+	for _, a := range kv.aliases {
+		delete(c.aliases, a)
+	}
+	if kv.protected {
+		c.protected--
+	}
+	if kv.gen != c.gen {
+		c.invalidated--
+	}
+	c.addBytes(-kv.size)
+	c.logRemove(kv.key)
+	c.debugf("kutta: evicted key %v", kv.key)
+	if c.sink != nil {
+		c.sunk = append(c.sunk, Evicted{kv.key, kv.value, reason})
+	}
+	if reason == ReasonExpired && c.onExpired != nil {
+		c.queue(c.onExpired, kv.key, kv.value)
+		c.closeOnRelease(kv)
+	} else {
+		c.release(kv)
+	}
+	c.evictions++
+	if c.sampledEvicted != nil && c.evictions%c.sampleEvery == 0 {
+		c.queue(c.sampledEvicted, kv.key, kv.value)
+	}
+}
+
+// release queues the callbacks due when kv's value leaves the cache:
+// its OnEvicted, then Close with WithCloseOnEvict.
+func (c *Cache) release(kv *entry) {
+	if kv.OnEvicted != nil {
+		c.queue(kv.OnEvicted, kv.key, kv.value)
+	}
+	c.closeOnRelease(kv)
+}
+
+// closeOnRelease queues Close for kv's value with WithCloseOnEvict.
+func (c *Cache) closeOnRelease(kv *entry) {
+	if _, ok := kv.value.(io.Closer); ok && c.closeOnEvict {
+		c.queue(c.closeValue, kv.key, kv.value)
+	}
+}
+
+// closeValue closes a value released under WithCloseOnEvict.
+func (c *Cache) closeValue(key Key, value interface{}) {
+	if err := value.(io.Closer).Close(); err != nil {
+		c.mu.RLock()
+		c.infof("kutta: closing value of %v: %v", key, err)
+		c.mu.RUnlock()
+	}
+}
+
+// runWithTimeout runs cb on its own goroutine and waits for it for at
+// most the WithOnEvictTimeout timeout, logging a callback that overruns
+// and leaving it to finish on its own.
+func (c *Cache) runWithTimeout(cb callback) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cb.fn(cb.key, cb.value)
+	}()
+	timer := time.NewTimer(c.evictTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		c.mu.RLock()
+		c.infof("kutta: callback for %v still running after %v, no longer waiting for it", cb.key, c.evictTimeout)
+		c.mu.RUnlock()
 	}
 }
-func (c *Cache) DeleteExpired() {
-	if c.Len() == 0 {
+
+// queue schedules fn to be called with key and value by unlock.
+func (c *Cache) queue(fn func(key Key, value interface{}), key Key, value interface{}) {
+	c.pending = append(c.pending, callback{fn, key, value})
+}
+
+// SetOnExpired registers fn to be called, instead of the entry's
+// OnEvicted, when an entry is removed because its ttl ran out, whether
+// by a read or by cleanup. Entries leaving for any other reason,
+// including capacity eviction, Remove and InvalidateAll, still get their
+// OnEvicted, so each removal calls exactly one of the two. Like
+// OnEvicted, fn runs after the cache lock has been released. A nil fn
+// restores OnEvicted for expired entries.
+func (c *Cache) SetOnExpired(fn func(key Key, value interface{})) {
+	c.lock()
+	defer c.unlock()
+	c.onExpired = fn
+}
+
+// SetSampledOnEvicted registers fn to be called on every everyN-th
+// eviction, in addition to any per-entry OnEvicted. A nil fn removes it.
+func (c *Cache) SetSampledOnEvicted(everyN int, fn func(key Key, value interface{})) {
+	c.lock()
+	defer c.unlock()
+	if everyN < 1 {
+		everyN = 1
+	}
+	c.sampleEvery = uint64(everyN)
+	c.sampledEvicted = fn
+}
+
+// DeleteExpired removes expired entries and returns how many it
+// removed. It examines min(n, Len()) entries, n being the sample size
+// set by WithCleanupSampleSize, or every entry without one; with
+// WithExpirationIndex it removes every expired entry instead.
+func (c *Cache) DeleteExpired() int {
+	_, removed := c.cleanup()
+	return removed
+}
+
+// cleanup is DeleteExpired, also returning how many entries it examined.
+func (c *Cache) cleanup() (scanned, removed int) {
+	c.lock()
+	defer c.unlock()
+	start := time.Now()
+	c.seenExpired = 0
+	scanned, removed = c.deleteExpired()
+	took := time.Since(start)
+	c.debugf("kutta: cleanup removed %d expired entries in %v", removed, took)
+	if fn := c.onCleanup; fn != nil {
+		c.queue(func(Key, interface{}) { fn(scanned, removed, took) }, nil, nil)
+	}
+	return
+}
+
+// deleteExpired runs one cleanup, returning how many entries it examined
+// and how many of those it removed.
+func (c *Cache) deleteExpired() (scanned, removed int) {
+	if c.len() == 0 {
 		return
 	}
-	now := time.Now().UnixNano()
-	rand.Seed(now)
-	count := rand.Intn(c.Len()) + 1
-	for _, v := range c.cache {
-		if count == 0 {
+	if c.invalidated > 0 {
+		scanned, removed = c.deleteInvalidated()
+	}
+	if c.expiry != nil {
+		s, r := c.deleteDue()
+		return scanned + s, removed + r
+	}
+	scan := c.len()
+	if c.sampleSize > 0 && c.sampleSize < scan {
+		scan = c.sampleSize
+	}
+	now := c.now()
+	// Map iteration order is unspecified, so a partial scan samples
+	// different entries on each sweep.
+	for _, ele := range c.cache {
+		if scan == 0 {
+			break
+		}
+		scan--
+		scanned++
+		if c.spent(ele.Value.(*entry), now) {
+			c.expireElement(ele)
+			removed++
+		}
+	}
+	return
+}
+
+// deleteInvalidated removes the entries left over from generations
+// before the last InvalidateAll.
+func (c *Cache) deleteInvalidated() (scanned, removed int) {
+	for ele := c.dl.Back(); ele != nil && c.invalidated > 0; {
+		prev := ele.Prev()
+		scanned++
+		if ele.Value.(*entry).gen != c.gen {
+			c.expireElement(ele)
+			removed++
+		}
+		ele = prev
+	}
+	return
+}
+
+// deleteDue pops every entry whose deadline has passed off the
+// expiration index.
+func (c *Cache) deleteDue() (scanned, removed int) {
+	now := c.now()
+	for c.expiry.Len() > 0 {
+		kv := (*c.expiry)[0]
+		scanned++
+		if !c.spent(kv, now) {
 			return
 		}
-		count--
-		kv := v.Value.(*entry)
-		if kv.Expiration > 0 && now > kv.Expiration {
-			c.removeElement(v)
+		c.expireElement(c.cache[kv.key])
+		removed++
+	}
+	return
+}
+
+// NextExpiration returns the earliest deadline among the entries in
+// the cache, and false if none has a ttl. The deadline may already have
+// passed if the entry has not been cleaned up yet, meaning a sweep is
+// due now. It is O(1) with WithExpirationIndex and O(n) otherwise.
+func (c *Cache) NextExpiration() (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var next int64
+	if c.expiry != nil {
+		if c.expiry.Len() > 0 {
+			next = (*c.expiry)[0].Expiration
+		}
+	} else {
+		for _, ele := range c.cache {
+			if e := ele.Value.(*entry).Expiration; e > 0 && (next == 0 || e < next) {
+				next = e
+			}
 		}
 	}
+	if next == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, next), true
 }
 
+// nextSweep returns how long the watchdog should sleep: the cleanup
+// interval d, or less if an indexed entry is due sooner.
+func (c *Cache) nextSweep(d time.Duration) time.Duration {
+	if c.cleanupPaused() {
+		return d
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.expiry != nil && c.expiry.Len() > 0 {
+		// Entries are only removed once past their stale period.
+		due := time.Until(time.Unix(0, (*c.expiry)[0].Expiration)) + c.staleFor
+		if due < 0 {
+			due = 0
+		}
+		if due < d {
+			d = due
+		}
+	}
+	return d
+}
+
+// Len returns the number of entries in O(1) time, including expired
+// entries that have not been removed yet.
 func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.len()
+}
+
+// LiveLen returns the number of entries that have not expired. Unlike
+// Len it scans the cache, taking O(n) time, except with
+// WithExpirationIndex, where it takes O(k) time for k expired entries
+// as long as no entries remain from before an InvalidateAll.
+func (c *Cache) LiveLen() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cache == nil {
+		return 0
+	}
+	now := c.now()
+	if c.expiry != nil && c.invalidated == 0 {
+		return c.dl.Len() - c.expiry.countDue(0, now)
+	}
+	n := 0
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		if !c.expiredAt(ele.Value.(*entry), now) {
+			n++
+		}
+	}
+	return n
+}
+
+// OrderedEntries returns the live keys from most to least recently
+// used. Under the default policy, eviction takes them from the end, so
+// the last key is the next to go.
+func (c *Cache) OrderedEntries() []Key {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cache == nil {
+		return nil
+	}
+	now := c.now()
+	keys := make([]Key, 0, c.dl.Len())
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expiredAt(kv, now) {
+			keys = append(keys, kv.key)
+		}
+	}
+	return keys
+}
+
+// CountFunc returns how many live entries match reports true for. match
+// is called with the read lock held and must not modify the cache.
+func (c *Cache) CountFunc(match func(key Key, value interface{}) bool) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cache == nil {
+		return 0
+	}
+	now := c.now()
+	n := 0
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expiredAt(kv, now) && match(kv.key, kv.value) {
+			n++
+		}
+	}
+	return n
+}
+
+// unlock releases the write lock taken by lock, then runs the eviction
+// callbacks the write queued and brings the cache's group back within
+// budget if the write pushed it over.
+func (c *Cache) unlock() {
+	if g := c.unlockLocal(); g != nil && g.over() {
+		g.enforce()
+	}
+}
+
+// unlockLocal is unlock without enforcing the budget of the cache's
+// group, which it returns.
+func (c *Cache) unlockLocal() *CacheGroup {
+	pending, g := c.pending, c.group
+	sink, sunk := c.sink, c.sunk
+	c.pending, c.sunk = nil, nil
+	flush := c.changeLog.flush(c)
+	c.mu.Unlock()
+	if flush != nil {
+		flush()
+	}
+	for _, cb := range pending {
+		if c.evictTimeout > 0 {
+			c.runWithTimeout(cb)
+		} else {
+			cb.fn(cb.key, cb.value)
+		}
+	}
+	if len(sunk) > 0 {
+		sink(sunk)
+	}
+	return g
+}
+
+func (c *Cache) len() int {
 	if c.cache == nil {
 		return 0
 	}
 	return c.dl.Len()
 }
 
+// Clear drops every entry without calling OnEvicted. The cache remains
+// usable afterwards.
 func (c *Cache) Clear() {
-	c.dl = nil
-	c.cache = nil
+	c.lock()
+	defer c.unlock()
+	c.logOp(changeClear)
+	c.clear()
+}
+
+func (c *Cache) clear() {
+	c.dl = list.New()
+	c.cache = make(map[interface{}]*list.Element)
+	c.peak = 0
+	c.tags = nil
+	c.aliases = nil
+	c.protected = 0
+	c.hand = nil
+	c.invalidated = 0
+	c.addBytes(-c.bytes)
+	if c.expiry != nil {
+		c.expiry = new(expHeap)
+	}
+}
+
+// InvalidateAll makes every entry currently in the cache read as
+// expired, in constant time. The entries are removed, firing OnEvicted,
+// by later cleanups or as they are read, and count toward Len and
+// MaxEntries until then.
+func (c *Cache) InvalidateAll() {
+	c.lock()
+	defer c.unlock()
+	c.invalidateAll()
+}
+
+func (c *Cache) invalidateAll() {
+	c.gen++
+	c.invalidated = c.len()
+	c.logOp(changeInvalidate)
+}
+
+// Close drops every entry without calling OnEvicted and releases the
+// cache's background resources: its watchdog, scheduler registration
+// and group membership. Afterwards reads miss, writes store nothing,
+// so a closed cache cannot come back to life without its watchdog, and
+// operations that return errors return ErrClosed. Closing twice is a
+// no-op.
+func (c *Cache) Close() {
+	c.shutdown(nil)
+}
+
+// Drain closes the cache like Close, but first calls fn once for every
+// entry still in it, including expired entries not yet removed, so the
+// resources they hold can be released. The watchdog is stopped before
+// fn is first called, so no entry can be evicted concurrently. fn is
+// called with the lock held and must not use the cache.
+func (c *Cache) Drain(fn func(key Key, value interface{})) {
+	c.shutdown(fn)
+}
+
+func (c *Cache) shutdown(drain func(key Key, value interface{})) {
+	c.FlushDebounced()
+	c.lock()
+	if c.closed {
+		c.unlock()
+		return
+	}
+	c.closed = true
+	dog, sched, group := c.WatchDog, c.sched, c.group
+	c.WatchDog = nil
+	if c.refreshStop != nil {
+		close(c.refreshStop)
+		c.refreshStop = nil
+	}
+	c.coarse = false
+	c.unlock()
+
+	if dog != nil {
+		runtime.SetFinalizer(c, nil)
+		dog.stop <- true
+		atomic.AddInt64(&activeWatchDogs, -1)
+	}
+	if sched != nil {
+		sched.Unregister(c)
+	}
+	if group != nil {
+		group.Unregister(c)
+	}
+
+	c.lock()
+	defer c.unlock()
+	if drain != nil && c.cache != nil {
+		for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+			if kv := ele.Value.(*entry); !kv.negative {
+				drain(kv.key, kv.value)
+			}
+		}
+	}
+	c.clear()
+}
+
+// Closed reports whether Close has been called, distinguishing a closed
+// cache from one that simply lacks a key.
+func (c *Cache) Closed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// String describes the cache in one line, for logs and debuggers.
+func (c *Cache) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cleanup := "lazy"
+	switch {
+	case c.closed:
+		cleanup = "closed"
+	case c.WatchDog != nil:
+		cleanup = c.WatchDog.Interval.String()
+	case c.sched != nil:
+		cleanup = "scheduler " + c.sched.Interval.String()
+	}
+	return fmt.Sprintf("kutta.Cache{len: %d, max: %d, cleanup: %s, hits: %.1f%%}",
+		c.len(), c.MaxEntries, cleanup, 100*c.Stats().HitRatio())
+}
+
+// Resize sets MaxEntries, evicting entries as capacity eviction would
+// until the cache fits, and returns how many it evicted. Zero removes
+// the limit. The victims are all removed under the lock before any of
+// their OnEvicted callbacks run, so even a large shrink holds the lock
+// only as long as the removals take.
+func (c *Cache) Resize(maxEntries int) int {
+	c.lock()
+	defer c.unlock()
+	c.MaxEntries = maxEntries
+	n := 0
+	for maxEntries != 0 && c.len() > maxEntries && c.evict() != nil {
+		n++
+	}
+	return n
+}
+
+// sparseMinPeak is the smallest high-water mark worth reallocating for.
+const sparseMinPeak = 64
+
+// ShrinkIfSparse rebuilds the underlying map when the live entries have
+// fallen below a quarter of its high-water mark, so the memory held by
+// the enlarged bucket array can be reclaimed. It reports whether the map
+// was rebuilt.
+func (c *Cache) ShrinkIfSparse() bool {
+	c.lock()
+	defer c.unlock()
+	if c.cache == nil || c.peak < sparseMinPeak || len(c.cache)*4 >= c.peak {
+		return false
+	}
+	m := make(map[interface{}]*list.Element, len(c.cache))
+	for k, v := range c.cache {
+		m[k] = v
+	}
+	c.cache = m
+	c.peak = len(m)
+	return true
+}
+
+// noteExpired records that an expired entry was found, and once
+// WithExpiredThreshold entries have been found since the last sweep,
+// asks for a sweep without waiting for the next one: the watchdog is
+// woken, and a cache without one sweeps when the current write ends.
+func (c *Cache) noteExpired() {
+	if c.maxExpired == 0 || c.cleanupPaused() {
+		return
+	}
+	if c.seenExpired++; c.seenExpired < c.maxExpired {
+		return
+	}
+	c.seenExpired = 0
+	if c.WatchDog != nil {
+		c.WatchDog.sweepSoon()
+		return
+	}
+	c.queue(func(Key, interface{}) { c.DeleteExpired() }, nil, nil)
+}
+
+// PauseCleanup stops the watchdog or scheduler from removing expired
+// entries until ResumeCleanup is called, e.g. around a bulk load. Reads
+// still remove the expired entries they find, and DeleteExpired still
+// works when called directly.
+func (c *Cache) PauseCleanup() {
+	atomic.StoreUint32(&c.paused, 1)
+}
+
+// ResumeCleanup undoes PauseCleanup. Cleanup resumes at the next
+// regular sweep rather than catching up on the ones skipped; call
+// DeleteExpired to sweep at once.
+func (c *Cache) ResumeCleanup() {
+	atomic.StoreUint32(&c.paused, 0)
+}
+
+func (c *Cache) cleanupPaused() bool {
+	return atomic.LoadUint32(&c.paused) != 0
 }
 
 type watchDog struct {
 	Interval time.Duration
 	stop     chan bool
+	wake     chan struct{}
+	sweep    chan struct{} // requests an immediate sweep
 }
 
 func (dog *watchDog) run(c *Cache) {
-	ticker := time.NewTicker(dog.Interval)
+	sleep := dog.Interval
+	timer := time.NewTimer(c.nextSweep(sleep))
 	for {
 		select {
-		case <-ticker.C:
-			c.DeleteExpired()
+		case <-timer.C:
+			sleep = dog.tick(c, sleep)
+		case <-dog.sweep:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			sleep = dog.tick(c, sleep)
+		case <-dog.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
 		case <-dog.stop:
-			ticker.Stop()
+			timer.Stop()
 			return
 		}
+		timer.Reset(c.nextSweep(sleep))
+	}
+}
+
+// tick runs one sweep and returns how long to sleep before the next,
+// given the last sleep.
+func (dog *watchDog) tick(c *Cache, sleep time.Duration) time.Duration {
+	atomic.StoreInt64(&c.clock, time.Now().UnixNano())
+	if c.cleanupPaused() {
+		return dog.Interval
+	}
+	var scanned, removed int
+	// Sweeping an empty cache cannot find anything.
+	if c.Len() > 0 {
+		scanned, removed = c.cleanup()
+	}
+	switch {
+	case removed == 0:
+		if sleep < c.idleBackoff {
+			sleep *= 2
+			if sleep > c.idleBackoff {
+				sleep = c.idleBackoff
+			}
+		}
+	case c.minInterval == 0:
+		sleep = dog.Interval
+	case removed*4 >= scanned:
+		sleep /= 2
+		if sleep < c.minInterval {
+			sleep = c.minInterval
+		}
+	}
+	atomic.StoreInt64(&c.interval, int64(sleep))
+	return sleep
+}
+
+// CleanupInterval returns how long the watchdog waits between sweeps,
+// which changes with WithIdleBackoff and WithAdaptiveInterval, or zero
+// for a cache without one. Called from the WithOnCleanup hook, it
+// returns the wait that preceded the sweep being reported.
+func (c *Cache) CleanupInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.interval))
+}
+
+// sweepSoon asks the watchdog to sweep now without blocking.
+func (dog *watchDog) sweepSoon() {
+	select {
+	case dog.sweep <- struct{}{}:
+	default:
+	}
+}
+
+// poke asks the watchdog to recompute its sleep without blocking.
+func (dog *watchDog) poke() {
+	if dog == nil {
+		return
+	}
+	select {
+	case dog.wake <- struct{}{}:
+	default:
 	}
 }
 
 func stopWatchDog(c *Cache) {
 	c.WatchDog.stop <- true
+	atomic.AddInt64(&activeWatchDogs, -1)
 }
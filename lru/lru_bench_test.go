@@ -0,0 +1,129 @@
+package kutta
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchKeys is the number of distinct keys most benchmarks cycle
+// through; it is a power of two so i&(benchKeys-1) picks one.
+const benchKeys = 1024
+
+// benchCache returns a cache holding keys 0 to benchKeys-1.
+func benchCache(b *testing.B, maxEntries int, opts ...Option) *Cache {
+	cache := New(maxEntries, time.Second, opts...)
+	b.Cleanup(cache.Close)
+	for i := 0; i < benchKeys; i++ {
+		cache.AddEx(i, i, time.Hour)
+	}
+	return cache
+}
+
+func BenchmarkAddNew(b *testing.B) {
+	cache := New(benchKeys, time.Second)
+	defer cache.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.AddEx(i, i, time.Hour)
+	}
+}
+
+func BenchmarkAddExisting(b *testing.B) {
+	cache := benchCache(b, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.AddEx(i&(benchKeys-1), i, time.Hour)
+	}
+}
+
+func benchmarkGet(b *testing.B, opts ...Option) {
+	cache := benchCache(b, 0, opts...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(i & (benchKeys - 1))
+	}
+}
+
+func BenchmarkGet(b *testing.B)            { benchmarkGet(b) }
+func BenchmarkGetCoarseClock(b *testing.B) { benchmarkGet(b, WithCoarseClock()) }
+
+func BenchmarkGetMiss(b *testing.B) {
+	cache := benchCache(b, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(-1 - i&(benchKeys-1))
+	}
+}
+
+func BenchmarkRemove(b *testing.B) {
+	cache := New(0, time.Second)
+	defer cache.Close()
+	for i := 0; i < b.N; i++ {
+		cache.AddEx(i, i, time.Hour)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Remove(i)
+	}
+}
+
+// benchmarkGetParallel measures read throughput with every processor
+// reading at once, where the lock taken by Get matters most.
+func benchmarkGetParallel(b *testing.B, opts ...Option) {
+	cache := benchCache(b, benchKeys, opts...)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cache.Get(i & (benchKeys - 1))
+		}
+	})
+}
+
+func BenchmarkGetParallelLRU(b *testing.B)   { benchmarkGetParallel(b) }
+func BenchmarkGetParallelClock(b *testing.B) { benchmarkGetParallel(b, WithPolicy(PolicyClock)) }
+
+// BenchmarkMixed runs a workload of nine reads to each write, split
+// across a fixed number of goroutines, to show how throughput scales
+// with contention.
+func BenchmarkMixed(b *testing.B) {
+	for _, goroutines := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			cache := benchCache(b, benchKeys)
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := g; i < b.N; i += goroutines {
+						key := i * 7 & (2*benchKeys - 1)
+						if i%10 == 0 {
+							cache.AddEx(key, i, time.Hour)
+						} else {
+							cache.Get(key)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkDeleteExpired measures a sweep of a cache whose entries have
+// all expired, refilling it between sweeps off the clock.
+func BenchmarkDeleteExpired(b *testing.B) {
+	const n = 10000
+	cache := NewLazy(0)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for k := 0; k < n; k++ {
+			cache.AddEx(k, k, time.Nanosecond)
+		}
+		time.Sleep(time.Microsecond)
+		b.StartTimer()
+		cache.DeleteExpired()
+	}
+}
@@ -1,21 +1,1834 @@
 package kutta
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func TestLru(t *testing.T) {
 	cache := New(2, time.Second*100)
+	var evicted []Key
 	onEvicted := func(key Key, value interface{}) {
-		fmt.Println(key, "is evicted ...")
+		evicted = append(evicted, key)
 	}
-	cache.AddExWithOnEvicted("hello", "world", time.Second, &onEvicted)
+	cache.AddExWithOnEvicted("hello", "world", time.Second, onEvicted)
 	cache.Add("world", "hello")
-	time.Sleep(time.Second * 5)
-	hello, ok := cache.Get("hello")
-	world, ok := cache.Get("world")
-	fmt.Println(hello, ok)
-	fmt.Println(world, ok)
+	cache.expireNow("hello")
+	if hello, ok := cache.Get("hello"); ok {
+		t.Errorf("Get(hello) = %v, %v; want expired", hello, ok)
+	}
+	if world, ok := cache.Get("world"); !ok || world != "hello" {
+		t.Errorf("Get(world) = %v, %v; want hello, true", world, ok)
+	}
+	if len(evicted) != 1 || evicted[0] != "hello" {
+		t.Errorf("evicted = %v; want [hello]", evicted)
+	}
+}
+
+func TestShrinkIfSparse(t *testing.T) {
+	cache := New(0, time.Hour)
+	for i := 0; i < 1000; i++ {
+		cache.Add(i, i)
+	}
+	if cache.ShrinkIfSparse() {
+		t.Fatal("ShrinkIfSparse rebuilt a dense map")
+	}
+	for i := 0; i < 900; i++ {
+		cache.Remove(i)
+	}
+	if !cache.ShrinkIfSparse() {
+		t.Fatal("ShrinkIfSparse did not rebuild a sparse map")
+	}
+	if cache.Len() != 100 {
+		t.Fatalf("Len = %d; want 100", cache.Len())
+	}
+	if v, ok := cache.Get(999); !ok || v != 999 {
+		t.Fatalf("Get(999) = %v, %v; want 999, true", v, ok)
+	}
+	if cache.ShrinkIfSparse() {
+		t.Fatal("ShrinkIfSparse rebuilt an already compact map")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	cache := New(0, time.Hour)
+	if old, had := cache.Swap("k", 1, NoExpiration); had || old != nil {
+		t.Fatalf("Swap on empty = %v, %v; want nil, false", old, had)
+	}
+	if old, had := cache.Swap("k", 2, NoExpiration); !had || old != 1 {
+		t.Fatalf("Swap = %v, %v; want 1, true", old, had)
+	}
+	if v, _ := cache.Get("k"); v != 2 {
+		t.Fatalf("Get = %v; want 2", v)
+	}
+	cache.AddEx("e", 1, time.Hour)
+	cache.expireNow("e")
+	if old, had := cache.Swap("e", 2, NoExpiration); had {
+		t.Fatalf("Swap over expired entry = %v, %v; want had false", old, had)
+	}
+}
+
+func TestSampledOnEvicted(t *testing.T) {
+	cache := New(1, time.Hour)
+	var sampled []Key
+	cache.SetSampledOnEvicted(3, func(key Key, value interface{}) {
+		sampled = append(sampled, key)
+	})
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i)
+	}
+	// Keys 0..8 are evicted; every third eviction is sampled.
+	if len(sampled) != 3 || sampled[0] != 2 || sampled[1] != 5 || sampled[2] != 8 {
+		t.Fatalf("sampled = %v; want [2 5 8]", sampled)
+	}
+}
+
+func TestAccessCount(t *testing.T) {
+	cache := New(0, time.Hour, WithAccessCount())
+	cache.Add("k", "v")
+	for i := 0; i < 3; i++ {
+		cache.Get("k")
+	}
+	if n, ok := cache.AccessCount("k"); !ok || n != 3 {
+		t.Fatalf("AccessCount = %d, %v; want 3, true", n, ok)
+	}
+	if _, ok := cache.AccessCount("missing"); ok {
+		t.Fatal("AccessCount reported a missing key")
+	}
+	plain := New(0, time.Hour)
+	plain.Add("k", "v")
+	plain.Get("k")
+	if _, ok := plain.AccessCount("k"); ok {
+		t.Fatal("AccessCount reported a count without WithAccessCount")
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	cache := New(0, time.Hour, WithAccessCount())
+	cache.Add("k", "v")
+	added, ok := cache.LastAccess("k")
+	if !ok {
+		t.Fatal("LastAccess missed a present key")
+	}
+	time.Sleep(time.Millisecond)
+	cache.Get("k")
+	if read, _ := cache.LastAccess("k"); !read.After(added) {
+		t.Fatalf("LastAccess = %v after Get; want later than %v", read, added)
+	}
+	if _, ok := New(0, time.Hour).LastAccess("k"); ok {
+		t.Fatal("LastAccess reported a time without WithAccessCount")
+	}
+}
+
+func TestExpirationIndex(t *testing.T) {
+	cache := New(0, time.Hour, WithExpirationIndex())
+	cache.AddEx("soon", 1, 20*time.Millisecond)
+	cache.AddEx("later", 2, time.Hour)
+	cache.Add("forever", 3)
+	cache.AddEx("moved", 4, 20*time.Millisecond)
+	cache.AddEx("moved", 4, time.Hour)
+
+	// The watchdog interval is an hour, so only the index can wake it.
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Len() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.Len() != 3 {
+		t.Fatalf("Len = %d; want 3", cache.Len())
+	}
+	if _, ok := cache.Get("moved"); !ok {
+		t.Fatal("entry whose ttl was extended was removed")
+	}
+	cache.Remove("later")
+	cache.mu.Lock()
+	n := cache.expiry.Len()
+	cache.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("index holds %d entries; want 1", n)
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	cache := New(3, time.Hour)
+	cache.AddAll([]Item{
+		{Key: "a", Value: 1, TTL: NoExpiration},
+		{Key: "b", Value: 2, TTL: time.Hour},
+		{Key: "c", Value: 3, TTL: NoExpiration},
+		{Key: "d", Value: 4, TTL: time.Hour},
+	})
+	if cache.Len() != 3 {
+		t.Fatalf("Len = %d; want 3", cache.Len())
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("earliest item survived capacity eviction")
+	}
+	for _, k := range []string{"b", "c", "d"} {
+		if _, ok := cache.Get(k); !ok {
+			t.Errorf("Get(%s) missed", k)
+		}
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	cache := New(0, time.Hour, WithExpirationIndex())
+	var evicted []Key
+	onEvicted := func(key Key, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	cache.AddExWithOnEvicted("old", 1, time.Hour, onEvicted)
+	cache.AddExWithOnEvicted("kept", 2, time.Hour, onEvicted)
+	cache.ReplaceAll([]Item{
+		{Key: "kept", Value: 20, TTL: time.Hour},
+		{Key: "new", Value: 30, TTL: NoExpiration},
+	})
+	if len(evicted) != 1 || evicted[0] != "old" {
+		t.Fatalf("evicted = %v; want [old]", evicted)
+	}
+	if v, ok := cache.Get("kept"); !ok || v != 20 {
+		t.Errorf("Get(kept) = %v, %v; want 20, true", v, ok)
+	}
+	if _, ok := cache.Get("old"); ok {
+		t.Error("old entry survived ReplaceAll")
+	}
+	cache.Remove("kept")
+	if len(evicted) != 2 || evicted[1] != "kept" {
+		t.Errorf("evicted = %v; want retained key to keep its callback", evicted)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Len = %d; want 1", cache.Len())
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	cache := New(0, time.Hour, WithLockStats())
+	cache.mu.Lock()
+	done := make(chan bool)
+	go func() {
+		cache.Add("k", "v")
+		done <- true
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cache.mu.Unlock()
+	<-done
+	st := cache.LockStats()
+	if st.Contended != 1 || st.Wait <= 0 || st.Acquisitions < 1 {
+		t.Fatalf("LockStats = %+v; want one contended acquisition", st)
+	}
+	if st := New(0, time.Hour).LockStats(); st != (LockStats{}) {
+		t.Fatalf("LockStats without option = %+v; want zero", st)
+	}
+}
+
+func TestGetIf(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("v1", 1)
+	cache.Add("v2", 2)
+	fresh := func(value interface{}) bool { return value.(int) >= 2 }
+	if v, ok := cache.GetIf("v2", fresh); !ok || v != 2 {
+		t.Errorf("GetIf(v2) = %v, %v; want 2, true", v, ok)
+	}
+	if v, ok := cache.GetIf("v1", fresh); ok {
+		t.Errorf("GetIf(v1) = %v, %v; want miss", v, ok)
+	}
+	if _, ok := cache.Get("v1"); ok {
+		t.Error("invalid entry was not evicted")
+	}
+	if _, ok := cache.GetIf("missing", fresh); ok {
+		t.Error("GetIf hit a missing key")
+	}
+}
+
+func TestTags(t *testing.T) {
+	cache := New(0, time.Hour, WithMaxKeysPerTag(2))
+	cache.AddWithTags("a", 1, NoExpiration, "global", "x")
+	cache.AddWithTags("b", 2, NoExpiration, "global")
+	cache.AddWithTags("c", 3, NoExpiration, "global")
+	if _, ok := cache.Get("a"); ok {
+		t.Error("oldest key of a full tag was not evicted")
+	}
+	if _, ok := cache.tags["x"]; ok {
+		t.Error("evicted entry still filed under its other tag")
+	}
+	if n := cache.InvalidateTag("global"); n != 2 {
+		t.Errorf("InvalidateTag = %d; want 2", n)
+	}
+	if cache.Len() != 0 || len(cache.tags) != 0 {
+		t.Errorf("Len = %d, tags = %d after invalidation; want 0, 0", cache.Len(), len(cache.tags))
+	}
+}
+
+func TestNextExpiration(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		var opts []Option
+		if indexed {
+			opts = append(opts, WithExpirationIndex())
+		}
+		cache := New(0, time.Hour, opts...)
+		cache.Add("forever", 1)
+		if _, ok := cache.NextExpiration(); ok {
+			t.Errorf("indexed=%v: NextExpiration reported a deadline without ttls", indexed)
+		}
+		start := time.Now()
+		cache.AddEx("late", 2, 2*time.Hour)
+		cache.AddEx("soon", 3, time.Hour)
+		next, ok := cache.NextExpiration()
+		if !ok || next.Before(start.Add(time.Hour)) || next.After(time.Now().Add(time.Hour)) {
+			t.Errorf("indexed=%v: NextExpiration = %v, %v; want about an hour from now", indexed, next, ok)
+		}
+	}
+}
+
+func TestEvictOnReplace(t *testing.T) {
+	cache := New(0, time.Hour, WithEvictOnReplace())
+	var evicted []interface{}
+	onEvicted := func(key Key, value interface{}) {
+		evicted = append(evicted, value)
+	}
+	cache.AddExWithOnEvicted("k", "first", NoExpiration, onEvicted)
+	cache.Add("k", "second")
+	if len(evicted) != 1 || evicted[0] != "first" {
+		t.Fatalf("evicted = %v; want [first]", evicted)
+	}
+	if v, _ := cache.Get("k"); v != "second" {
+		t.Fatalf("Get = %v; want second", v)
+	}
+	_, version, _ := cache.GetWithVersion("k")
+	cache.CompareVersionAndSwap("k", version, "third")
+	cache.ReplaceAll([]Item{{Key: "k", Value: "fourth", TTL: NoExpiration}})
+	if got := fmt.Sprint(evicted); got != "[first second third]" {
+		t.Fatalf("evicted = %s; want [first second third]", got)
+	}
+	cache.AddExWithOnEvicted("f", 1.0, NoExpiration, onEvicted)
+	cache.IncrementFloat("f", 1, NoExpiration)
+	if got := fmt.Sprint(evicted); got != "[first second third 1]" {
+		t.Fatalf("evicted = %s; want [first second third 1]", got)
+	}
+}
+
+func TestCloseOnEvictReplace(t *testing.T) {
+	var events []string
+	cache := New(0, time.Hour, WithEvictOnReplace(), WithCloseOnEvict())
+	cache.Add("a", closer{&events})
+	cache.ReplaceAll([]Item{{Key: "a", Value: "plain", TTL: NoExpiration}})
+	if got := strings.Join(events, " "); got != "close" {
+		t.Fatalf("events = %q; want close", got)
+	}
+}
+
+func TestNewLazy(t *testing.T) {
+	cache := NewLazy(0, WithExpirationIndex())
+	if cache.WatchDog != nil {
+		t.Fatal("NewLazy started a watchdog")
+	}
+	cache.AddEx("k", "v", time.Hour)
+	cache.expireNow("k")
+	if _, ok := cache.Get("k"); ok {
+		t.Fatal("expired entry returned by lazy cache")
+	}
+	cache.AddEx("k", "v", time.Hour)
+	cache.expireNow("k")
+	cache.DeleteExpired()
+	if cache.Len() != 0 {
+		t.Fatalf("Len = %d after DeleteExpired; want 0", cache.Len())
+	}
+}
+
+type testLogger struct{ debug, info []string }
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.info = append(l.info, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	cache := New(1, time.Hour)
+	l := new(testLogger)
+	cache.SetLogger(l)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	if len(l.debug) != 2 {
+		t.Fatalf("debug log = %q; want overflow and eviction", l.debug)
+	}
+	cache.SetLogger(nil)
+	cache.Add("c", 3)
+	if len(l.debug) != 2 {
+		t.Fatalf("removed logger still called: %q", l.debug)
+	}
+}
+
+func TestAddReturning(t *testing.T) {
+	cache := New(2, time.Hour)
+	cache.Add("a", 1)
+	if evicted, _ := cache.AddReturning("b", 2, NoExpiration); evicted {
+		t.Fatal("AddReturning reported an eviction below capacity")
+	}
+	if evicted, key := cache.AddReturning("b", 3, NoExpiration); evicted {
+		t.Fatalf("AddReturning reported evicting %v on update", key)
+	}
+	if evicted, key := cache.AddReturning("c", 4, NoExpiration); !evicted || key != "a" {
+		t.Fatalf("AddReturning = %v, %v; want true, a", evicted, key)
+	}
+}
+
+func TestPreserveTTLOnUpdate(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		var opts []Option
+		if preserve {
+			opts = append(opts, WithPreserveTTLOnUpdate())
+		}
+		cache := New(0, time.Hour, opts...)
+		cache.AddEx("k", 1, time.Hour)
+		cache.Add("k", 2)
+		_, hasTTL := cache.NextExpiration()
+		if hasTTL != preserve {
+			t.Errorf("preserve=%v: entry has ttl = %v after Add", preserve, hasTTL)
+		}
+		cache.AddEx("k", 3, 2*time.Hour)
+		if next, _ := cache.NextExpiration(); time.Until(next) < time.Hour+30*time.Minute {
+			t.Errorf("preserve=%v: positive ttl did not reset deadline", preserve)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "a")
+	_, v1, ok := cache.GetWithVersion("k")
+	if !ok {
+		t.Fatal("GetWithVersion missed")
+	}
+	if !cache.CompareVersionAndSwap("k", v1, "b") {
+		t.Fatal("CompareVersionAndSwap failed at current version")
+	}
+	if cache.CompareVersionAndSwap("k", v1, "c") {
+		t.Fatal("CompareVersionAndSwap succeeded at stale version")
+	}
+	cache.Remove("k")
+	cache.Add("k", "a")
+	if _, v, _ := cache.GetWithVersion("k"); v <= v1 {
+		t.Fatalf("re-added entry has version %d; want > %d", v, v1)
+	}
+	if cache.CompareVersionAndSwap("missing", 0, "x") {
+		t.Fatal("CompareVersionAndSwap succeeded on a missing key")
+	}
+}
+
+func TestClearAndClose(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "v")
+	cache.Clear()
+	if cache.Len() != 0 || cache.Closed() {
+		t.Fatalf("after Clear: Len = %d, Closed = %v; want 0, false", cache.Len(), cache.Closed())
+	}
+	cache.Add("k", "v")
+	if _, ok := cache.Get("k"); !ok {
+		t.Fatal("cache unusable after Clear")
+	}
+	cache.Close()
+	cache.Close()
+	if !cache.Closed() {
+		t.Fatal("Closed = false after Close")
+	}
+	if _, ok := cache.Get("k"); ok {
+		t.Fatal("Get hit after Close")
+	}
+	if err := cache.Save(new(bytes.Buffer)); err != ErrClosed {
+		t.Fatalf("Save after Close = %v; want ErrClosed", err)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	cache := New(0, time.Hour)
+	if cache.AddAlias("missing", "m") {
+		t.Fatal("AddAlias succeeded for a missing primary")
+	}
+	cache.Add("uuid-1", "object")
+	cache.AddAlias("uuid-1", "slug")
+	if v, ok := cache.Get("slug"); !ok || v != "object" {
+		t.Fatalf("Get(slug) = %v, %v; want object, true", v, ok)
+	}
+	cache.RemoveAlias("slug")
+	if _, ok := cache.Get("slug"); ok {
+		t.Fatal("removed alias still resolves")
+	}
+	cache.AddAlias("uuid-1", "slug")
+	cache.Remove("uuid-1")
+	if _, ok := cache.Get("slug"); ok {
+		t.Fatal("alias outlived its primary")
+	}
+	if len(cache.aliases) != 0 {
+		t.Fatalf("alias map holds %d entries; want 0", len(cache.aliases))
+	}
+}
+
+func TestAliasLookups(t *testing.T) {
+	cache := New(0, time.Hour, WithAccessCount())
+	cache.Add("uuid-1", "object")
+	cache.AddAlias("uuid-1", "slug")
+	if v, version, ok := cache.GetWithVersion("slug"); !ok || v != "object" || version == 0 {
+		t.Fatalf("GetWithVersion(slug) = %v, %d, %v; want object, >0, true", v, version, ok)
+	}
+	calls := 0
+	upper := func(v interface{}) interface{} {
+		calls++
+		return strings.ToUpper(v.(string))
+	}
+	for i := 0; i < 2; i++ {
+		if v, ok := cache.GetTransformedMemo("slug", upper); !ok || v != "OBJECT" {
+			t.Fatalf("GetTransformedMemo(slug) = %v, %v; want OBJECT, true", v, ok)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("transform ran %d times; want 1", calls)
+	}
+	if n, ok := cache.AccessCount("slug"); !ok || n == 0 {
+		t.Fatalf("AccessCount(slug) = %d, %v; want >0, true", n, ok)
+	}
+	if info, ok := cache.ViewEntry("slug"); !ok || info.Value != "object" {
+		t.Fatalf("ViewEntry(slug) = %+v, %v; want object", info, ok)
+	}
+	if v, ok := cache.GetIf("slug", func(interface{}) bool { return true }); !ok || v != "object" {
+		t.Fatalf("GetIf(slug) = %v, %v; want object, true", v, ok)
+	}
+	_, version, _ := cache.GetWithVersion("slug")
+	if !cache.CompareVersionAndSwap("slug", version, "swapped") {
+		t.Fatal("CompareVersionAndSwap(slug) failed with the version read through the alias")
+	}
+	cache.Modify("slug", time.Hour, false, func(old interface{}, found bool) (interface{}, bool) {
+		return fmt.Sprint(old, "!"), found
+	})
+	if v, inserted := cache.AddOrGet("slug", "other", time.Hour); inserted || v != "swapped!" {
+		t.Fatalf("AddOrGet(slug) = %v, %v; want swapped!, false", v, inserted)
+	}
+	if !cache.Pin("slug") || !cache.SetPriority("slug", 3) {
+		t.Fatal("Pin or SetPriority missed the alias")
+	}
+	if info, _ := cache.ViewEntry("uuid-1"); info.Value != "swapped!" || info.Priority != 3 || cache.Len() != 1 {
+		t.Fatalf("uuid-1 = %+v with %d entries; want swapped! with priority 3, alone", info, cache.Len())
+	}
+}
+
+func TestEvictionComparator(t *testing.T) {
+	byPriority := func(a, b *EntryView) bool { return a.Priority < b.Priority }
+	cache := New(2, time.Hour, WithEvictionComparator(byPriority))
+	cache.Add("important", 1)
+	cache.SetPriority("important", 10)
+	cache.Add("b", 2)
+	cache.Add("c", 3)
+	if _, ok := cache.Get("important"); !ok {
+		t.Fatal("high priority entry was evicted")
+	}
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("low priority entry survived")
+	}
+}
+
+func TestString(t *testing.T) {
+	cache := New(10, time.Minute)
+	cache.Add("k", "v")
+	if got, want := fmt.Sprint(cache), "kutta.Cache{len: 1, max: 10, cleanup: 1m0s, hits: 0.0%}"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+	if got, want := NewLazy(0).String(), "kutta.Cache{len: 0, max: 0, cleanup: lazy, hits: 0.0%}"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+}
+
+func TestSLRUScanResistance(t *testing.T) {
+	for _, p := range []Policy{PolicyLRU, PolicySLRU} {
+		cache := New(10, time.Hour, WithPolicy(p))
+		for i := 0; i < 5; i++ {
+			cache.Add(i, i)
+			cache.Get(i)
+		}
+		for i := 100; i < 200; i++ {
+			cache.Add(i, i)
+		}
+		survivors := 0
+		for i := 0; i < 5; i++ {
+			if _, ok := cache.Get(i); ok {
+				survivors++
+			}
+		}
+		if want := map[Policy]int{PolicyLRU: 0, PolicySLRU: 5}[p]; survivors != want {
+			t.Errorf("policy %d: %d hot entries survived the scan; want %d", p, survivors, want)
+		}
+	}
+}
+
+func TestSLRUProtectedCap(t *testing.T) {
+	cache := New(5, time.Hour, WithPolicy(PolicySLRU))
+	for i := 0; i < 5; i++ {
+		cache.Add(i, i)
+		cache.Get(i)
+	}
+	if cache.protected != cache.protectedCap() {
+		t.Fatalf("protected = %d; want cap %d", cache.protected, cache.protectedCap())
+	}
+	cache.Add(5, 5)
+	if cache.Len() != 5 {
+		t.Fatalf("Len = %d; want 5", cache.Len())
+	}
+}
+
+func TestSetPolicy(t *testing.T) {
+	cache := New(5, time.Hour, WithPolicy(PolicySLRU))
+	for i := 0; i < 5; i++ {
+		cache.Add(i, i)
+		cache.Get(i)
+	}
+	cache.SetPolicy(PolicyLRU)
+	if cache.Policy() != PolicyLRU || cache.protected != 0 {
+		t.Fatalf("Policy, protected = %d, %d; want PolicyLRU, 0", cache.Policy(), cache.protected)
+	}
+	order := cache.OrderedEntries()
+	oldest := order[len(order)-1]
+	cache.Add(5, 5)
+	if _, ok := cache.Get(oldest); ok {
+		t.Fatal("LRU eviction kept the formerly protected oldest entry")
+	}
+}
+
+func TestActiveCaches(t *testing.T) {
+	before := ActiveCaches()
+	cache := New(0, time.Hour)
+	lazy := NewLazy(0)
+	if n := ActiveCaches(); n != before+1 {
+		t.Fatalf("ActiveCaches = %d; want %d", n, before+1)
+	}
+	cache.Close()
+	lazy.Close()
+	if n := ActiveCaches(); n != before {
+		t.Fatalf("ActiveCaches = %d after Close; want %d", n, before)
+	}
+}
+
+func TestOnEvictedReentrant(t *testing.T) {
+	cache := New(1, time.Hour)
+	onEvicted := func(key Key, value interface{}) {
+		if key == "a" {
+			cache.AddEx("reloaded", value, NoExpiration)
+		}
+	}
+	cache.AddExWithOnEvicted("a", 1, NoExpiration, onEvicted)
+	done := make(chan bool)
+	go func() {
+		cache.Add("b", 2)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Add deadlocked on a callback that uses the cache")
+	}
+	if v, ok := cache.Get("reloaded"); !ok || v != 1 {
+		t.Fatalf("Get(reloaded) = %v, %v; want 1, true", v, ok)
+	}
+}
+
+func TestViewEntry(t *testing.T) {
+	cache := New(0, time.Hour, WithAccessCount())
+	cache.AddWithSize("k", "v", time.Hour, 42)
+	cache.Get("k")
+	info, ok := cache.ViewEntry("k")
+	if !ok {
+		t.Fatal("ViewEntry missed")
+	}
+	if info.Key != "k" || info.Value != "v" || info.Size != 42 || info.Accesses != 1 {
+		t.Errorf("ViewEntry = %+v", info)
+	}
+	if info.TTL <= 59*time.Minute || info.Expiration.IsZero() {
+		t.Errorf("TTL = %v, Expiration = %v; want about an hour", info.TTL, info.Expiration)
+	}
+	cache.Add("permanent", "v")
+	if info, _ := cache.ViewEntry("permanent"); info.TTL != NoExpiration || !info.Expiration.IsZero() {
+		t.Errorf("TTL = %v, Expiration = %v for a permanent entry; want NoExpiration and zero", info.TTL, info.Expiration)
+	}
+	cache.ViewEntry("k")
+	if n, _ := cache.AccessCount("k"); n != 1 {
+		t.Errorf("AccessCount = %d after ViewEntry; want 1", n)
+	}
+	if _, ok := cache.ViewEntry("missing"); ok {
+		t.Error("ViewEntry hit a missing key")
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, asMiss := range []bool{false, true} {
+		var opts []Option
+		if asMiss {
+			opts = append(opts, WithCountExpiredAsMiss())
+		}
+		cache := New(0, time.Hour, opts...)
+		cache.Add("k", 1)
+		cache.AddEx("e", 2, time.Hour)
+		cache.expireNow("e")
+		cache.Get("k")
+		cache.Get("k")
+		cache.Get("missing")
+		cache.Get("e")
+		want := Stats{Hits: 2, Misses: 1, Expired: 1}
+		if asMiss {
+			want = Stats{Hits: 2, Misses: 2}
+		}
+		if got := cache.Stats(); got != want {
+			t.Errorf("asMiss=%v: Stats = %+v; want %+v", asMiss, got, want)
+		}
+		if r := cache.Stats().HitRatio(); r != 0.5 {
+			t.Errorf("asMiss=%v: HitRatio = %v; want 0.5", asMiss, r)
+		}
+		cache.ResetStats()
+		if got := cache.Stats(); got != (Stats{}) {
+			t.Errorf("Stats after reset = %+v", got)
+		}
+	}
+}
+
+func TestGetTransformed(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "abc")
+	calls := 0
+	upper := func(stored interface{}) interface{} {
+		calls++
+		return strings.ToUpper(stored.(string))
+	}
+	if v, ok := cache.GetTransformed("k", upper); !ok || v != "ABC" {
+		t.Fatalf("GetTransformed = %v, %v; want ABC, true", v, ok)
+	}
+	if v, _ := cache.Get("k"); v != "abc" {
+		t.Fatalf("stored value changed to %v", v)
+	}
+	calls = 0
+	for i := 0; i < 3; i++ {
+		if v, ok := cache.GetTransformedMemo("k", upper); !ok || v != "ABC" {
+			t.Fatalf("GetTransformedMemo = %v, %v; want ABC, true", v, ok)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("transform called %d times; want 1", calls)
+	}
+	cache.Add("k", "xyz")
+	if v, _ := cache.GetTransformedMemo("k", upper); v != "XYZ" {
+		t.Fatalf("GetTransformedMemo = %v after update; want XYZ", v)
+	}
+	if _, ok := cache.GetTransformedMemo("missing", upper); ok {
+		t.Fatal("GetTransformedMemo hit a missing key")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cache := New(0, time.Hour)
+	evictions := 0
+	onEvicted := func(key Key, value interface{}) { evictions++ }
+	cache.AddExWithOnEvicted("a", 1, time.Hour, onEvicted)
+	cache.AddExWithOnEvicted("b", 2, time.Hour, onEvicted)
+	cache.expireNow("b")
+	drained := map[Key]int{}
+	cache.Drain(func(key Key, value interface{}) {
+		drained[key]++
+	})
+	if len(drained) != 2 || drained["a"] != 1 || drained["b"] != 1 {
+		t.Fatalf("drained = %v; want a and b once each", drained)
+	}
+	if cache.Len() != 0 || !cache.Closed() {
+		t.Fatalf("Len = %d, Closed = %v after Drain; want 0, true", cache.Len(), cache.Closed())
+	}
+	if evictions != 0 {
+		t.Fatalf("OnEvicted fired %d times during Drain; want 0", evictions)
+	}
+}
+
+func TestCoarseClock(t *testing.T) {
+	cache := New(0, 10*time.Millisecond, WithCoarseClock())
+	defer cache.Close()
+	cache.AddEx("k", "v", 20*time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if cache.Len() != 0 {
+		t.Fatal("entry never expired under the coarse clock")
+	}
+	if lazy := NewLazy(0, WithCoarseClock()); lazy.coarse {
+		t.Fatal("coarse clock enabled without a watchdog")
+	}
+}
+
+func TestPolicyClock(t *testing.T) {
+	cache := New(3, time.Hour, WithPolicy(PolicyClock))
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.Add("c", 3)
+	cache.Get("a")
+	cache.Add("d", 4) // a has a second chance, b is evicted
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("unreferenced entry survived")
+	}
+	if got := fmt.Sprint(cache.OrderedEntries()); got != "[d c a]" {
+		t.Fatalf("OrderedEntries = %s; Get must not reorder the list", got)
+	}
+	cache.Add("e", 5) // the hand moves on to c
+	if _, ok := cache.Get("c"); ok {
+		t.Fatal("hand did not move past the referenced entry")
+	}
+	if err := cache.VerifyInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	cache := New(2, time.Hour)
+	cache.Add("config", 1)
+	if !cache.Pin("config") || cache.Pin("missing") {
+		t.Fatal("Pin reported the wrong presence")
+	}
+	cache.Add("a", 2)
+	cache.Add("b", 3)
+	if _, ok := cache.Get("config"); !ok {
+		t.Fatal("pinned entry was evicted")
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("eviction did not walk past the pinned tail")
+	}
+	cache.Pin("b")
+	cache.RemoveOldest()
+	if cache.Len() != 2 {
+		t.Fatalf("Len = %d; RemoveOldest removed a pinned entry", cache.Len())
+	}
+	cache.Unpin("config")
+	cache.RemoveOldest()
+	if _, ok := cache.Get("config"); ok {
+		t.Fatal("unpinned entry survived RemoveOldest")
+	}
+}
+
+func TestContainsAllAny(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.AddEx("old", 3, time.Millisecond)
+	cache.expireNow("old")
+	if !cache.ContainsAll([]Key{"a", "b"}) || cache.ContainsAll([]Key{"a", "old"}) {
+		t.Fatal("ContainsAll gave the wrong answer")
+	}
+	if !cache.ContainsAny([]Key{"old", "b"}) || cache.ContainsAny([]Key{"old", "c"}) {
+		t.Fatal("ContainsAny gave the wrong answer")
+	}
+	if !cache.ContainsAll(nil) || cache.ContainsAny(nil) {
+		t.Fatal("empty key sets gave the wrong answer")
+	}
+}
+
+func TestVerifyInvariants(t *testing.T) {
+	cache := New(3, time.Hour, WithExpirationIndex(), WithSizer(func(v interface{}) int64 { return int64(v.(int)) }))
+	for i := 0; i < 5; i++ {
+		cache.AddEx(i, i, time.Duration(i+1)*time.Minute)
+	}
+	cache.AddAlias("alias", 4)
+	cache.Remove(3)
+	if err := cache.VerifyInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.mu.Lock()
+	cache.bytes++
+	cache.mu.Unlock()
+	if err := cache.VerifyInvariants(); err == nil {
+		t.Fatal("VerifyInvariants missed a corrupted byte total")
+	}
+}
+
+func TestAddOrGet(t *testing.T) {
+	cache := New(0, time.Hour)
+	if v, inserted := cache.AddOrGet("k", 1, time.Hour); !inserted || v != 1 {
+		t.Fatalf("AddOrGet = %v, %v; want 1, true", v, inserted)
+	}
+	if v, inserted := cache.AddOrGet("k", 2, time.Hour); inserted || v != 1 {
+		t.Fatalf("AddOrGet = %v, %v; want 1, false", v, inserted)
+	}
+	cache.expireNow("k")
+	if v, inserted := cache.AddOrGet("k", 3, time.Hour); !inserted || v != 3 {
+		t.Fatalf("AddOrGet over an expired entry = %v, %v; want 3, true", v, inserted)
+	}
+}
+
+type closer struct{ closed *[]string }
+
+func (c closer) Close() error {
+	*c.closed = append(*c.closed, "close")
+	return nil
+}
+
+func TestCloseOnEvict(t *testing.T) {
+	var events []string
+	onEvicted := func(key Key, value interface{}) { events = append(events, "evicted") }
+	cache := New(1, time.Hour, WithCloseOnEvict())
+	cache.AddExWithOnEvicted("a", closer{&events}, NoExpiration, onEvicted)
+	cache.Add("b", closer{&events})
+	cache.Remove("b")
+	cache.Add("c", "not a closer")
+	cache.Remove("c")
+	if got, want := strings.Join(events, " "), "evicted close close"; got != want {
+		t.Fatalf("events = %q; want %q", got, want)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	fill := func(c *Cache, live, expired int) {
+		for i := 0; i < live; i++ {
+			c.AddEx(fmt.Sprint("live", i), i, time.Hour)
+		}
+		for i := 0; i < expired; i++ {
+			k := fmt.Sprint("expired", i)
+			c.AddEx(k, i, time.Hour)
+			c.expireNow(k)
+		}
+	}
+	tests := []struct {
+		name           string
+		live, expired  int
+		sample         int
+		removed, after int
+	}{
+		{"empty", 0, 0, 0, 0, 0},
+		{"none expired", 5, 0, 0, 0, 5},
+		{"all expired", 0, 5, 0, 5, 0},
+		{"partial", 3, 4, 0, 4, 3},
+		{"sampled all expired", 0, 10, 4, 4, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewLazy(0, WithCleanupSampleSize(tt.sample))
+			fill(cache, tt.live, tt.expired)
+			if n := cache.DeleteExpired(); n != tt.removed {
+				t.Errorf("DeleteExpired = %d; want %d", n, tt.removed)
+			}
+			if cache.Len() != tt.after {
+				t.Errorf("Len = %d; want %d", cache.Len(), tt.after)
+			}
+		})
+	}
+}
+
+func TestIncrementFloat(t *testing.T) {
+	cache := New(0, time.Hour)
+	if n := cache.IncrementFloat("k", 1.5, time.Hour); n != 1.5 {
+		t.Fatalf("IncrementFloat = %v; want 1.5", n)
+	}
+	if n := cache.IncrementFloat("k", 2, 0); n != 3.5 {
+		t.Fatalf("IncrementFloat = %v; want 3.5", n)
+	}
+	if _, ok := cache.NextExpiration(); !ok {
+		t.Fatal("IncrementFloat reset the entry's ttl")
+	}
+	cache.Add("s", "not a float")
+	if n := cache.IncrementFloat("s", 1, NoExpiration); n != 1 {
+		t.Fatalf("IncrementFloat over a string = %v; want 1", n)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("user:1", 1)
+	cache.Add("user:2", 2)
+	cache.Add("order:1", 3)
+	cache.Add(42, 4)
+	cache.AddEx("user:old", 5, time.Hour)
+	cache.expireNow("user:old")
+
+	if keys := fmt.Sprint(cache.KeysWithPrefix("user:")); keys != "[user:2 user:1]" {
+		t.Fatalf("KeysWithPrefix = %s; want [user:2 user:1]", keys)
+	}
+	if n := cache.CountWithPrefix(""); n != 3 {
+		t.Fatalf("CountWithPrefix(\"\") = %d; want 3 live string keys", n)
+	}
+	if n := cache.RemovePrefix("user:"); n != 3 {
+		t.Fatalf("RemovePrefix = %d; want 3", n)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("Len = %d after RemovePrefix; want 2", cache.Len())
+	}
+}
+
+func TestAddExWithOnEvictedPtr(t *testing.T) {
+	cache := New(0, time.Hour)
+	var evicted []Key
+	onEvicted := func(key Key, value interface{}) { evicted = append(evicted, key) }
+	cache.AddExWithOnEvictedPtr("a", 1, NoExpiration, &onEvicted)
+	cache.AddExWithOnEvictedPtr("b", 2, NoExpiration, nil)
+	cache.Remove("a")
+	cache.Remove("b")
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Fatalf("evicted = %v; want [a]", evicted)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.AddEx("k", "v", time.Hour)
+	cache.Add("forever", 1)
+	r := cache.Lookup("k")
+	if !r.Found || r.Expired || r.Value != "v" || r.ExpiresAt.Before(time.Now()) {
+		t.Fatalf("Lookup = %+v; want a live value expiring later", r)
+	}
+	if r := cache.Lookup("forever"); !r.Found || !r.ExpiresAt.IsZero() {
+		t.Fatalf("Lookup = %+v; want a value without deadline", r)
+	}
+	cache.expireNow("k")
+	if r := cache.Lookup("k"); r.Found || !r.Expired || r.Value != nil {
+		t.Fatalf("Lookup = %+v; want an expired entry", r)
+	}
+	if r := cache.Lookup("missing"); r != (Result{}) {
+		t.Fatalf("Lookup = %+v; want the zero Result", r)
+	}
+}
+
+func TestIdleBackoff(t *testing.T) {
+	sweeps := func(opts ...Option) int {
+		cache := New(0, time.Millisecond, opts...)
+		defer cache.Close()
+		l := new(testLogger)
+		cache.SetLogger(l)
+		cache.Add("k", "v")
+		time.Sleep(60 * time.Millisecond)
+		cache.mu.RLock()
+		defer cache.mu.RUnlock()
+		return len(l.debug)
+	}
+	steady, backedOff := sweeps(), sweeps(WithIdleBackoff(time.Hour))
+	if backedOff > 10 || backedOff >= steady {
+		t.Fatalf("%d sweeps with backoff, %d without; want backoff to sweep far less", backedOff, steady)
+	}
+}
+
+func TestGetAndTouch(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.AddEx("k", "v", time.Millisecond)
+	if v, ok := cache.GetAndTouch("k", time.Hour); !ok || v != "v" {
+		t.Fatalf("GetAndTouch = %v, %v; want v, true", v, ok)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.Get("k"); !ok {
+		t.Fatal("GetAndTouch did not extend the deadline")
+	}
+	if _, ok := cache.GetAndTouch("missing", time.Hour); ok {
+		t.Fatal("GetAndTouch found a missing key")
+	}
+}
+
+func TestZeroTTL(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.AddEx("forever", 1, NoExpiration)
+	cache.AddEx("later", 2, time.Hour)
+	cache.AddEx("never", 3, 0)
+	if _, ok := cache.Get("never"); ok || cache.Len() != 2 {
+		t.Fatalf("zero ttl value was stored, Len = %d", cache.Len())
+	}
+	if _, ok := cache.NextExpiration(); !ok {
+		t.Fatal("positive ttl set no deadline")
+	}
+	cache.AddEx("later", 4, 0)
+	if _, ok := cache.Get("later"); ok {
+		t.Fatal("zero ttl left the previous value in place")
+	}
+	if _, ok := cache.NextExpiration(); ok {
+		t.Fatal("negative ttl set a deadline")
+	}
+	if v, ok := cache.GetAndTouch("forever", 0); !ok || v != 1 || cache.Len() != 0 {
+		t.Fatalf("GetAndTouch with zero ttl = %v, %v, Len %d; want 1, true, 0", v, ok, cache.Len())
+	}
+}
+
+func TestCanEvict(t *testing.T) {
+	inUse := map[Key]bool{"a": true}
+	canEvict := func(key Key, value interface{}) bool { return !inUse[key] }
+	cache := New(2, time.Hour, WithCanEvict(canEvict, false))
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+	cache.Add("c", 3)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("vetoed entry was evicted")
+	}
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("eviction did not move on to the next candidate")
+	}
+
+	inUse["c"], inUse["d"] = true, true
+	cache.Add("d", 4)
+	if cache.Len() != 3 {
+		t.Fatalf("Len = %d; want 3 with every older entry vetoed", cache.Len())
+	}
+
+	forced := New(1, time.Hour, WithCanEvict(func(Key, interface{}) bool { return false }, true))
+	forced.Add("a", 1)
+	forced.Add("b", 2)
+	if forced.Len() != 1 {
+		t.Fatalf("Len = %d; want forced eviction", forced.Len())
+	}
+}
+
+func TestOrderedEntries(t *testing.T) {
+	cache := New(0, time.Hour)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		cache.Add(k, k)
+	}
+	cache.Get("a")
+	cache.expireNow("c")
+	if got := fmt.Sprint(cache.OrderedEntries()); got != "[a d b]" {
+		t.Fatalf("OrderedEntries = %s; want [a d b]", got)
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "v")
+	cache.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := cache.TryGet(ctx, "k"); err != context.DeadlineExceeded {
+		t.Fatalf("TryGet on a held lock = %v; want DeadlineExceeded", err)
+	}
+	cache.mu.Unlock()
+	if v, ok, err := cache.TryGet(context.Background(), "k"); err != nil || !ok || v != "v" {
+		t.Fatalf("TryGet = %v, %v, %v; want v, true, nil", v, ok, err)
+	}
+}
+
+func TestInvalidateAll(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithExpirationIndex()}} {
+		cache := New(0, time.Hour, opts...)
+		var evicted int
+		onEvicted := func(key Key, value interface{}) { evicted++ }
+		cache.AddExWithOnEvicted("a", 1, time.Hour, onEvicted)
+		cache.AddExWithOnEvicted("b", 2, NoExpiration, onEvicted)
+		cache.AddExWithOnEvicted("c", 3, NoExpiration, onEvicted)
+		cache.InvalidateAll()
+		if _, ok := cache.Get("a"); ok {
+			t.Fatal("invalidated entry was served")
+		}
+		cache.Add("b", 20)
+		if v, ok := cache.Get("b"); !ok || v != 20 {
+			t.Fatalf("Get(b) = %v, %v after re-adding; want 20, true", v, ok)
+		}
+		if n := cache.DeleteExpired(); n != 1 {
+			t.Fatalf("DeleteExpired = %d; want the 1 invalidated entry left", n)
+		}
+		if cache.Len() != 1 || evicted != 2 {
+			t.Fatalf("Len, evicted = %d, %d; want 1, 2", cache.Len(), evicted)
+		}
+		if err := cache.VerifyInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	cache := New(0, time.Hour)
+	for _, k := range []string{"e", "d", "c", "b", "a"} {
+		cache.Add(k, k)
+	}
+	cache.expireNow("b")
+	it := cache.Iterator()
+	var seen []Key
+	for {
+		key, _, ok := it.Next()
+		if !ok {
+			break
+		}
+		seen = append(seen, key)
+		if key == "c" {
+			cache.Remove("d") // the entry the cursor points at
+		}
+	}
+	if got := fmt.Sprint(seen); got != "[a c e]" {
+		t.Fatalf("iterated %s; want [a c e]", got)
+	}
+}
+
+func TestCountFunc(t *testing.T) {
+	cache := New(0, time.Hour)
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i%3)
+	}
+	cache.expireNow(0)
+	n := cache.CountFunc(func(key Key, value interface{}) bool { return value == 0 })
+	if n != 3 {
+		t.Fatalf("CountFunc = %d; want 3", n)
+	}
+}
+
+func TestAddUntil(t *testing.T) {
+	cache := New(0, time.Hour)
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	cache.AddUntil("k", "v", deadline)
+	if r := cache.Lookup("k"); !r.Found || !r.ExpiresAt.Equal(deadline) {
+		t.Fatalf("Lookup = %+v; want a value expiring at %v", r, deadline)
+	}
+	cache.AddUntil("k", "v", time.Now().Add(-time.Second))
+	if _, ok := cache.Get("k"); ok || cache.Len() != 0 {
+		t.Fatal("past deadline stored a value")
+	}
+	cache.AddUntil("k", "v", time.Unix(0, 0))
+	if cache.Len() != 0 {
+		t.Fatal("a deadline at the epoch stored a permanent value")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primary, secondary := New(2, time.Hour), New(0, time.Hour)
+	primary.SetMirror(secondary)
+	primary.AddEx("a", 1, time.Hour)
+	primary.Add("b", 2)
+	primary.Add("c", 3) // evicts a from the primary only
+	primary.Remove("b")
+	if got := fmt.Sprint(secondary.OrderedEntries()); got != "[c a]" {
+		t.Fatalf("secondary holds %s; want [c a]", got)
+	}
+	primary.AddEx("a", 1, time.Hour)
+	want, _ := primary.NextExpiration()
+	if got, _ := secondary.NextExpiration(); !got.Equal(want) {
+		t.Fatalf("secondary deadline %v; want the primary's %v", got, want)
+	}
+	primary.SetMirror(nil)
+	primary.Add("d", 4)
+	if _, ok := secondary.Get("d"); ok {
+		t.Fatal("write mirrored after SetMirror(nil)")
+	}
+}
+
+func TestMirrorInPlaceUpdates(t *testing.T) {
+	primary, secondary := New(0, time.Hour, WithMaxValueSize(10)), New(0, time.Hour)
+	primary.SetMirror(secondary)
+	primary.IncrementFloat("f", 1, time.Hour)
+	primary.IncrementFloat("f", 1, time.Hour)
+	if v, _ := secondary.Get("f"); v != 2.0 {
+		t.Fatalf("f = %v on the secondary; want 2", v)
+	}
+	primary.Add("v", "old")
+	_, version, _ := primary.GetWithVersion("v")
+	primary.CompareVersionAndSwap("v", version, "new")
+	if v, _ := secondary.Get("v"); v != "new" {
+		t.Fatalf("v = %v on the secondary; want new", v)
+	}
+	primary.GetAndTouch("v", time.Minute)
+	want, _ := primary.ViewEntry("v")
+	if got, _ := secondary.ViewEntry("v"); !got.Expiration.Equal(want.Expiration) {
+		t.Fatalf("v expires at %v on the secondary; want %v", got.Expiration, want.Expiration)
+	}
+	primary.AddWithSize("big", "x", time.Hour, 11)
+	if _, ok := secondary.Get("big"); ok {
+		t.Fatal("rejected value reached the secondary")
+	}
+}
+
+func TestMirrorRemovals(t *testing.T) {
+	primary, secondary := New(0, time.Hour, WithMaxValueSize(10)), New(0, time.Hour)
+	primary.SetMirror(secondary)
+	for _, k := range []Key{"zero", "modify", "touch", "getif", "big", "old"} {
+		primary.Add(k, 1)
+	}
+	primary.AddEx("zero", 1, 0)
+	primary.Modify("modify", time.Hour, false, func(interface{}, bool) (interface{}, bool) { return nil, false })
+	primary.GetAndTouch("touch", 0)
+	primary.GetIf("getif", func(interface{}) bool { return false })
+	primary.AddWithSize("big", 2, time.Hour, 11)
+	if got := fmt.Sprint(secondary.OrderedEntries()); got != "[old]" {
+		t.Fatalf("secondary holds %s; want [old]", got)
+	}
+	primary.ReplaceAll([]Item{{Key: "new", Value: 2, TTL: time.Hour}})
+	if got := fmt.Sprint(secondary.OrderedEntries()); got != "[new]" {
+		t.Fatalf("secondary holds %s after ReplaceAll; want [new]", got)
+	}
+}
+
+func TestGetFresh(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "v")
+	if v, ok := cache.GetFresh("k", time.Hour); !ok || v != "v" {
+		t.Fatalf("GetFresh = %v, %v; want v, true", v, ok)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.GetFresh("k", time.Millisecond); ok {
+		t.Fatal("GetFresh served a value older than maxAge")
+	}
+	if _, ok := cache.Get("k"); !ok {
+		t.Fatal("GetFresh removed the stale value")
+	}
+	cache.Add("k", "w")
+	if v, ok := cache.GetFresh("k", time.Millisecond); !ok || v != "w" {
+		t.Fatalf("GetFresh after update = %v, %v; want w, true", v, ok)
+	}
+}
+
+func TestAgeStats(t *testing.T) {
+	cache := New(0, time.Hour)
+	if st := cache.AgeStats(); st != (AgeStats{}) {
+		t.Fatalf("AgeStats of an empty cache = %+v", st)
+	}
+	cache.Add("old", 1)
+	time.Sleep(20 * time.Millisecond)
+	cache.AddEx("new", 2, time.Hour)
+	cache.AddEx("gone", 3, time.Hour)
+	cache.expireNow("gone")
+	st := cache.AgeStats()
+	if st.WithTTL != 1 || st.Permanent != 1 {
+		t.Fatalf("WithTTL, Permanent = %d, %d; want 1, 1", st.WithTTL, st.Permanent)
+	}
+	if st.P95Age < 20*time.Millisecond || st.P50Age > st.P95Age || st.MeanAge > st.P95Age {
+		t.Fatalf("ages = %+v; want P95 at least 20ms and above the mean and median", st)
+	}
+}
+
+func TestOnCleanup(t *testing.T) {
+	type sweep struct{ scanned, removed int }
+	sweeps := make(chan sweep, 100)
+	cache := New(0, time.Millisecond, WithOnCleanup(func(scanned, removed int, took time.Duration) {
+		select {
+		case sweeps <- sweep{scanned, removed}:
+		default:
+		}
+	}))
+	defer cache.Close()
+	cache.Add("kept", 1)
+	cache.AddEx("gone", 2, time.Hour)
+	cache.expireNow("gone")
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case s := <-sweeps:
+			if s.removed == 0 {
+				continue
+			}
+			if s.removed != 1 || s.scanned != 2 {
+				t.Fatalf("sweep scanned %d and removed %d; want 2 and 1", s.scanned, s.removed)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no cleanup reported removing the expired entry")
+		}
+	}
+}
+
+func TestLoadMap(t *testing.T) {
+	m := map[Key]interface{}{"a": 1, "b": 2, "c": 3}
+	cache := New(2, time.Hour)
+	cache.Add("old", 0)
+	if err := cache.LoadMap(m, time.Hour, LoadFail); err != ErrTooLarge || cache.Len() != 1 {
+		t.Fatalf("LoadFail = %v with Len %d; want ErrTooLarge and nothing loaded", err, cache.Len())
+	}
+	if err := cache.LoadMap(m, time.Hour, LoadTruncate); err != nil || cache.Len() != 2 {
+		t.Fatalf("LoadTruncate = %v with Len %d; want nil and 2", err, cache.Len())
+	}
+	if _, ok := cache.Get("old"); ok {
+		t.Fatal("LoadTruncate kept an entry not in the map")
+	}
+	if err := cache.LoadMap(m, time.Hour, LoadGrow); err != nil || cache.Len() != 3 || cache.MaxEntries != 3 {
+		t.Fatalf("LoadGrow = %v with Len %d, MaxEntries %d; want nil, 3, 3", err, cache.Len(), cache.MaxEntries)
+	}
+
+	cache = New(3, time.Hour)
+	cache.Add("x", 0)
+	cache.Add("a", 0)
+	cache.LoadMap(map[Key]interface{}{"a": 1, "b": 2}, time.Hour, LoadFail)
+	if got := cache.CountFunc(func(Key, interface{}) bool { return true }); got != 3 {
+		t.Fatalf("%d live entries; want x kept since the map fits beside it", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cache := New(0, time.Hour)
+	ro := cache.ReadOnly()
+	cache.Add("a", 1)
+	if v, ok := ro.Get("a"); !ok || v != 1 || ro.Len() != 1 {
+		t.Fatalf("Get = %v, %v with Len %d; want the cache's entry", v, ok, ro.Len())
+	}
+	if _, ok := ro.(interface{ Add(Key, interface{}) }); ok {
+		t.Fatal("the view exposes Add")
+	}
+}
+
+func TestAddDebounced(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", 0)
+	for i := 1; i <= 3; i++ {
+		cache.AddDebounced("k", i, time.Hour, time.Hour)
+	}
+	if v, _ := cache.Get("k"); v != 0 {
+		t.Fatalf("Get = %v inside the window; want the old value 0", v)
+	}
+	cache.FlushDebounced()
+	if v, _ := cache.Get("k"); v != 3 {
+		t.Fatalf("Get = %v after flushing; want the last write 3", v)
+	}
+
+	cache.AddDebounced("j", 1, time.Hour, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, _ := cache.Get("j"); v == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the write was not stored when its window closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cache.AddDebounced("c", 1, time.Hour, time.Hour)
+	var drained []Key
+	cache.Drain(func(key Key, value interface{}) { drained = append(drained, key) })
+	if len(drained) != 3 {
+		t.Fatalf("Drain saw %v; want the buffered write to c included", drained)
+	}
+}
+
+func TestResize(t *testing.T) {
+	cache := New(0, time.Hour)
+	evicted := 0
+	onEvicted := func(Key, interface{}) {
+		if !cache.mu.TryLock() {
+			t.Error("OnEvicted ran with the lock held")
+			return
+		}
+		cache.mu.Unlock()
+		time.Sleep(10 * time.Microsecond)
+		evicted++
+	}
+	for i := 0; i < 1000; i++ {
+		cache.AddExWithOnEvicted(i, i, time.Hour, onEvicted)
+	}
+	if n := cache.Resize(10); n != 990 || evicted != 990 || cache.Len() != 10 {
+		t.Fatalf("Resize = %d with %d callbacks and Len %d; want 990, 990, 10", n, evicted, cache.Len())
+	}
+	if _, ok := cache.Get(999); !ok {
+		t.Fatal("Resize evicted the newest entry")
+	}
+}
+
+func TestAddAligned(t *testing.T) {
+	cache := New(0, time.Hour)
+	before := time.Now()
+	cache.AddAligned("a", 1, time.Minute)
+	info, ok := cache.ViewEntry("a")
+	if !ok {
+		t.Fatal("AddAligned stored nothing")
+	}
+	want := before.Truncate(time.Minute).Add(time.Minute)
+	if !info.Expiration.Equal(want) && !info.Expiration.Equal(want.Add(time.Minute)) {
+		t.Fatalf("Expiration = %v; want the minute boundary %v", info.Expiration, want)
+	}
+	if info.Expiration.Truncate(time.Minute) != info.Expiration {
+		t.Fatalf("Expiration = %v is not on a minute boundary", info.Expiration)
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	if hot := New(0, time.Hour).HotKeys(1); hot != nil {
+		t.Fatalf("HotKeys = %v without WithWriteCounts; want nil", hot)
+	}
+	cache := New(0, time.Hour, WithWriteCounts())
+	for i := 0; i < 5; i++ {
+		cache.Add("hot", i)
+	}
+	cache.Add("warm", 0)
+	cache.Add("warm", 1)
+	cache.Add("cold", 0)
+	hot := cache.HotKeys(5)
+	if len(hot) != 2 || hot[0] != (KeyWrites{"hot", 4}) || hot[1] != (KeyWrites{"warm", 1}) {
+		t.Fatalf("HotKeys = %v; want [{hot 4} {warm 1}]", hot)
+	}
+	if hot := cache.HotKeys(1); len(hot) != 1 || hot[0].Key != "hot" {
+		t.Fatalf("HotKeys(1) = %v; want only hot", hot)
+	}
+	for _, n := range []int{0, -1} {
+		if hot := cache.HotKeys(n); hot != nil {
+			t.Fatalf("HotKeys(%d) = %v; want nil", n, hot)
+		}
+	}
+}
+
+func TestSetOnExpired(t *testing.T) {
+	cache := New(2, time.Hour)
+	var expired, evicted []Key
+	cache.SetOnExpired(func(key Key, _ interface{}) { expired = append(expired, key) })
+	onEvicted := func(key Key, _ interface{}) { evicted = append(evicted, key) }
+	cache.AddExWithOnEvicted("read", 1, time.Hour, onEvicted)
+	cache.AddExWithOnEvicted("swept", 1, time.Hour, onEvicted)
+	cache.expireNow("read")
+	cache.expireNow("swept")
+	cache.Get("read")
+	cache.DeleteExpired()
+	cache.AddExWithOnEvicted("a", 1, time.Hour, onEvicted)
+	cache.AddExWithOnEvicted("b", 1, time.Hour, onEvicted)
+	cache.AddExWithOnEvicted("c", 1, time.Hour, onEvicted)
+	cache.Remove("b")
+	if got := fmt.Sprint(expired, evicted); got != "[read swept] [a b]" {
+		t.Fatalf("expired, evicted = %s; want [read swept] [a b]", got)
+	}
+}
+
+func TestOverwriteExpired(t *testing.T) {
+	cache := New(0, time.Hour)
+	var expired, evicted []Key
+	cache.SetOnExpired(func(key Key, _ interface{}) { expired = append(expired, key) })
+	onEvicted := func(key Key, _ interface{}) { evicted = append(evicted, key) }
+	for _, k := range []Key{"add", "swap", "modify", "drop"} {
+		cache.AddExWithOnEvicted(k, 1, time.Hour, onEvicted)
+		cache.expireNow(k)
+	}
+	cache.Add("add", 2)
+	if old, had := cache.Swap("swap", 2, time.Hour); had {
+		t.Fatalf("Swap returned expired value %v", old)
+	}
+	cache.Modify("modify", time.Hour, false, func(old interface{}, found bool) (interface{}, bool) {
+		return 2, true
+	})
+	cache.Modify("drop", time.Hour, false, func(old interface{}, found bool) (interface{}, bool) {
+		return nil, false
+	})
+	if got := fmt.Sprint(expired, evicted); got != "[add swap modify drop] []" {
+		t.Fatalf("expired, evicted = %s; want [add swap modify drop] []", got)
+	}
+	for _, k := range []Key{"add", "swap", "modify"} {
+		if v, ok := cache.Get(k); !ok || v != 2 {
+			t.Fatalf("Get(%v) = %v, %v; want 2, true", k, v, ok)
+		}
+	}
+}
+
+func TestLiveLen(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithExpirationIndex()}} {
+		cache := New(0, time.Hour, opts...)
+		cache.Add("a", 1)
+		cache.AddEx("b", 1, time.Hour)
+		cache.AddEx("c", 1, time.Hour)
+		cache.expireNow("c")
+		if cache.Len() != 3 || cache.LiveLen() != 2 {
+			t.Fatalf("Len, LiveLen = %d, %d; want 3, 2", cache.Len(), cache.LiveLen())
+		}
+		cache.InvalidateAll()
+		cache.Add("d", 1)
+		if cache.LiveLen() != 1 {
+			t.Fatalf("LiveLen = %d after InvalidateAll; want 1", cache.LiveLen())
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	cache := New(0, time.Hour)
+	var evicted []Key
+	cache.AddEx("tmp", "v", time.Hour)
+	cache.AddExWithOnEvicted("id", "old", time.Hour, func(key Key, _ interface{}) { evicted = append(evicted, key) })
+	cache.Add("newest", 0)
+	cache.AddAlias("tmp", "alias")
+	before, _ := cache.ViewEntry("tmp")
+	if !cache.Rename("tmp", "id") {
+		t.Fatal("Rename reported a live key as absent")
+	}
+	after, ok := cache.ViewEntry("id")
+	if !ok || after.Value != "v" || !after.Expiration.Equal(before.Expiration) {
+		t.Fatalf("id = %+v; want the renamed entry with its deadline", after)
+	}
+	if _, ok := cache.ViewEntry("tmp"); ok || len(evicted) != 1 {
+		t.Fatalf("tmp still present or %v evicted; want [id]", evicted)
+	}
+	if v, _ := cache.Get("alias"); v != "v" {
+		t.Fatalf("Get(alias) = %v; want the alias to follow the entry", v)
+	}
+	if keys := cache.OrderedEntries(); fmt.Sprint(keys) != "[id newest]" {
+		t.Fatalf("OrderedEntries = %v; want [id newest]", keys)
+	}
+	if cache.Rename("missing", "x") {
+		t.Fatal("Rename reported success for an absent key")
+	}
+}
+
+func TestRenameOverExpired(t *testing.T) {
+	cache := New(0, time.Hour)
+	var expired, evicted []Key
+	cache.SetOnExpired(func(key Key, _ interface{}) { expired = append(expired, key) })
+	cache.AddEx("tmp", "v", time.Hour)
+	cache.AddExWithOnEvicted("id", "old", time.Hour, func(key Key, _ interface{}) { evicted = append(evicted, key) })
+	cache.expireNow("id")
+	cache.Rename("tmp", "id")
+	if got := fmt.Sprint(expired, evicted); got != "[id] []" {
+		t.Fatalf("expired, evicted = %s; want [id] []", got)
+	}
+}
+
+func TestPauseCleanup(t *testing.T) {
+	cache := New(0, time.Millisecond, WithExpirationIndex())
+	defer cache.Close()
+	cache.PauseCleanup()
+	cache.AddEx("k", "v", time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if cache.Len() != 1 {
+		t.Fatal("the watchdog removed an entry while paused")
+	}
+	cache.ResumeCleanup()
+	deadline := time.Now().Add(time.Second)
+	for cache.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the watchdog did not resume")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpiredThreshold(t *testing.T) {
+	for _, interval := range []time.Duration{0, time.Hour} {
+		cache := New(0, interval, WithExpiredThreshold(2))
+		for i := 0; i < 10; i++ {
+			cache.AddEx(i, i, time.Hour)
+			cache.expireNow(i)
+		}
+		cache.Get(9)
+		cache.Add("new", 1)
+		deadline := time.Now().Add(time.Second)
+		for cache.Len() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Len = %d with interval %v; want the expired entries swept", cache.Len(), interval)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cache.Close()
+	}
+}
+
+func TestModify(t *testing.T) {
+	cache := New(0, time.Hour)
+	appendTo := func(old interface{}, found bool) (interface{}, bool) {
+		if !found {
+			return []string{"first"}, true
+		}
+		return append(old.([]string), "next"), true
+	}
+	cache.Modify("k", time.Hour, false, appendTo)
+	before, _ := cache.ViewEntry("k")
+	cache.Modify("k", NoExpiration, false, appendTo)
+	after, _ := cache.ViewEntry("k")
+	if fmt.Sprint(after.Value) != "[first next]" || !after.Expiration.Equal(before.Expiration) {
+		t.Fatalf("k = %v expiring %v; want [first next] keeping %v", after.Value, after.Expiration, before.Expiration)
+	}
+	if after.Version == before.Version {
+		t.Fatal("Modify did not bump the version")
+	}
+	cache.Modify("k", NoExpiration, true, appendTo)
+	if info, _ := cache.ViewEntry("k"); info.TTL != NoExpiration {
+		t.Fatalf("TTL = %v after resetting to NoExpiration", info.TTL)
+	}
+	cache.Modify("k", NoExpiration, false, func(interface{}, bool) (interface{}, bool) { return nil, false })
+	if cache.Len() != 0 {
+		t.Fatal("Modify kept an entry fn dropped")
+	}
+}
+
+func TestEvictionSink(t *testing.T) {
+	var batches [][]Evicted
+	cache := New(0, time.Hour, WithEvictionSink(func(evicted []Evicted) {
+		batches = append(batches, evicted)
+	}))
+	for i := 0; i < 4; i++ {
+		cache.AddEx(i, i, time.Hour)
+	}
+	cache.expireNow(0)
+	cache.expireNow(1)
+	cache.DeleteExpired()
+	cache.Resize(1)
+	cache.Remove(3)
+	cache.Remove(3)
+	if len(batches) != 3 {
+		t.Fatalf("%d batches; want one per removing write", len(batches))
+	}
+	for i, want := range []EvictionReason{ReasonExpired, ReasonCapacity, ReasonRemoved} {
+		if b := batches[i]; b[0].Reason != want || len(b) != []int{2, 1, 1}[i] {
+			t.Errorf("batch %d = %v; want reason %v", i, b, want)
+		}
+	}
+	if batches[1][0].Key != 2 || batches[2][0].Value != 3 {
+		t.Errorf("batches = %v; want 2 evicted and 3 removed", batches)
+	}
+}
+
+func TestAdaptiveInterval(t *testing.T) {
+	cache := New(0, time.Hour, WithAdaptiveInterval(time.Second, 8*time.Second))
+	defer cache.Close()
+	dog := cache.WatchDog
+	cache.Add("permanent", 1)
+	if d := dog.tick(cache, 4*time.Second); d != 8*time.Second {
+		t.Fatalf("idle sweep slept %v; want backoff to 8s", d)
+	}
+	for i := 0; i < 3; i++ {
+		cache.AddEx(i, i, time.Hour)
+		cache.expireNow(i)
+	}
+	if d := dog.tick(cache, 4*time.Second); d != 2*time.Second || cache.CleanupInterval() != d {
+		t.Fatalf("busy sweep slept %v, CleanupInterval %v; want both 2s", d, cache.CleanupInterval())
+	}
+	cache.AddEx("x", 1, time.Hour)
+	cache.expireNow("x")
+	for i := 0; i < 10; i++ {
+		cache.Add(i, i)
+	}
+	if d := dog.tick(cache, 2*time.Second); d != 2*time.Second {
+		t.Fatalf("sweep finding few expired slept %v; want it unchanged", d)
+	}
+	if d := dog.tick(cache, time.Second); d != 2*time.Second {
+		t.Fatalf("idle sweep slept %v; want 2s", d)
+	}
+}
+
+func TestExpirationHistogram(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("permanent", 1)
+	cache.AddEx("a", 1, 30*time.Second)
+	cache.AddEx("b", 1, 50*time.Second)
+	cache.AddEx("c", 1, 90*time.Second)
+	cache.AddEx("gone", 1, time.Hour)
+	cache.expireNow("gone")
+	h := cache.ExpirationHistogram(time.Minute)
+	if fmt.Sprint(h) != "map[-1:1 0:2 1:1]" {
+		t.Fatalf("ExpirationHistogram = %v; want map[-1:1 0:2 1:1]", h)
+	}
+	for _, bucket := range []time.Duration{0, -time.Minute} {
+		if h := cache.ExpirationHistogram(bucket); h != nil {
+			t.Fatalf("ExpirationHistogram(%v) = %v; want nil", bucket, h)
+		}
+	}
+}
+
+func TestClosedCacheIgnoresWrites(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Close()
+	cache.Add("a", 1)
+	cache.AddEx("b", 1, time.Hour)
+	cache.IncrementFloat("c", 1, time.Hour)
+	cache.ReplaceAll([]Item{{Key: "d", Value: 1, TTL: NoExpiration}})
+	if cache.AddWithSize("e", 1, time.Hour, 1) {
+		t.Error("AddWithSize reported storing into a closed cache")
+	}
+	if err := cache.LoadMap(map[Key]interface{}{"f": 1}, time.Hour, LoadFail); err != ErrClosed {
+		t.Errorf("LoadMap = %v; want ErrClosed", err)
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("Len = %d; want writes to a closed cache ignored", cache.Len())
+	}
+}
+
+func TestSeedFrom(t *testing.T) {
+	old := New(0, time.Hour)
+	old.AddEx("a", 1, time.Hour)
+	old.Add("b", 2)
+	old.AddEx("gone", 3, time.Hour)
+	old.expireNow("gone")
+	old.Get("a")
+	cache := New(0, time.Hour)
+	cache.Add("own", 0)
+	cache.SeedFrom(old)
+	if got := fmt.Sprint(cache.OrderedEntries()); got != "[a b own]" {
+		t.Fatalf("OrderedEntries = %s; want [a b own]", got)
+	}
+	want, _ := old.ViewEntry("a")
+	if got, _ := cache.ViewEntry("a"); !got.Expiration.Equal(want.Expiration) {
+		t.Fatalf("a expires at %v; want %v as in the source", got.Expiration, want.Expiration)
+	}
+	if old.Len() != 3 {
+		t.Fatal("SeedFrom changed the source cache")
+	}
+}
+
+func TestInsertProbation(t *testing.T) {
+	survivors := func(opts ...Option) int {
+		cache := New(10, time.Hour, opts...)
+		for i := 0; i < 5; i++ {
+			cache.Add(fmt.Sprint("hot", i), i)
+			cache.Get(fmt.Sprint("hot", i))
+		}
+		for i := 0; i < 100; i++ {
+			cache.Add(i, i) // a scan of keys read once
+		}
+		n := 0
+		for i := 0; i < 5; i++ {
+			if _, ok := cache.Get(fmt.Sprint("hot", i)); ok {
+				n++
+			}
+		}
+		if cache.Len() != 10 {
+			t.Fatalf("Len = %d; want capacity kept", cache.Len())
+		}
+		return n
+	}
+	if n := survivors(); n != 0 {
+		t.Fatalf("%d hot keys survived the scan with InsertFront; want 0", n)
+	}
+	if n := survivors(WithInsertionPolicy(InsertProbation)); n != 5 {
+		t.Fatalf("%d hot keys survived the scan with InsertProbation; want 5", n)
+	}
+}
+
+func TestGetWithDepth(t *testing.T) {
+	cache := New(0, time.Hour)
+	for _, k := range []string{"c", "b", "a"} {
+		cache.Add(k, k)
+	}
+	if v, depth, ok := cache.GetWithDepth("c"); !ok || v != "c" || depth != 2 {
+		t.Fatalf("GetWithDepth(c) = %v, %d, %v; want c, 2, true", v, depth, ok)
+	}
+	if _, depth, _ := cache.GetWithDepth("c"); depth != 0 {
+		t.Fatalf("depth = %d after promotion; want 0", depth)
+	}
+	if _, depth, ok := cache.GetWithDepth("missing"); ok || depth != -1 {
+		t.Fatalf("GetWithDepth(missing) = %d, %v; want -1, false", depth, ok)
+	}
+}
+
+func TestOnEvictTimeout(t *testing.T) {
+	cache := New(0, time.Hour, WithOnEvictTimeout(10*time.Millisecond))
+	l := new(testLogger)
+	cache.SetLogger(l)
+	hung := make(chan struct{})
+	defer close(hung)
+	cache.AddExWithOnEvicted("k", 1, time.Hour, func(Key, interface{}) { <-hung })
+	done := make(chan struct{})
+	go func() {
+		cache.Remove("k")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Remove waited for a hung OnEvicted")
+	}
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	if len(l.info) != 1 || !strings.Contains(l.info[0], "still running") {
+		t.Fatalf("logged %q; want the overrun reported", l.info)
+	}
+}
+
+func TestApproxMemoryBytes(t *testing.T) {
+	cache := New(0, time.Hour)
+	if n := cache.ApproxMemoryBytes(); n != 0 {
+		t.Fatalf("ApproxMemoryBytes = %d for an empty cache; want 0", n)
+	}
+	for i := 0; i < 100; i++ {
+		cache.Add(i, i)
+	}
+	base := cache.ApproxMemoryBytes()
+	if base < 100*int64(unsafe.Sizeof(entry{})) {
+		t.Fatalf("ApproxMemoryBytes = %d; want at least the entries themselves", base)
+	}
+	sized := New(0, time.Hour, WithSizer(func(interface{}) int64 { return 1000 }))
+	for i := 0; i < 100; i++ {
+		sized.Add(i, i)
+	}
+	if got := sized.ApproxMemoryBytes(); got != base+100*1000 {
+		t.Fatalf("ApproxMemoryBytes = %d with a Sizer; want %d", got, base+100*1000)
+	}
 }
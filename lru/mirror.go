@@ -0,0 +1,42 @@
+package kutta
+
+// SetMirror replays writes on c to secondary, keeping it as a warm
+// standby: every value stored in c, by one of its Add methods, a
+// loader, ReplaceAll or an in-place update such as Modify or
+// IncrementFloat, is stored in secondary with the same deadline once c
+// has accepted it. Every key given to Remove, or removed by a write
+// such as a zero ttl, a rejected value, Modify, GetAndTouch, GetIf or
+// ReplaceAll, is removed from it. A nil secondary stops mirroring.
+//
+// Mirroring is best effort and eventually consistent. Each write is
+// replayed after c's lock is released, so concurrent writers may reach
+// secondary in a different order than they reached c, and secondary
+// applies its own capacity, policy and options. Evictions, expiries
+// and bulk removals such as RemovePrefix and InvalidateTag on c are
+// not mirrored. Caches must not mirror each other in a cycle.
+func (c *Cache) SetMirror(secondary *Cache) {
+	c.lock()
+	defer c.unlock()
+	c.mirror = secondary
+}
+
+// mirrorPut queues the replay of kv's current value and deadline.
+func (c *Cache) mirrorPut(kv *entry) {
+	m, e, negative := c.mirror, kv.Expiration, kv.negative
+	c.queue(func(key Key, value interface{}) {
+		m.lock()
+		defer m.unlock()
+		m.putAt(key, value, e, m.now(), nil, m.sizeOf(value))
+		if ele, hit := m.cache[key]; hit && negative {
+			ele.Value.(*entry).negative = true
+		}
+	}, kv.key, kv.value)
+}
+
+// mirrorRemove queues the replay of Remove(key).
+func (c *Cache) mirrorRemove(key Key) {
+	m := c.mirror
+	c.queue(func(key Key, _ interface{}) {
+		m.Remove(key)
+	}, key, nil)
+}
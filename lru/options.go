@@ -0,0 +1,292 @@
+package kutta
+
+import "time"
+
+// An Option configures a Cache at construction time.
+type Option func(c *Cache)
+
+// WithAccessCount enables per-entry hit counters and access times, see
+// Cache.AccessCount and Cache.LastAccess.
+func WithAccessCount() Option {
+	return func(c *Cache) {
+		c.trackAccess = true
+	}
+}
+
+// WithWriteCounts enables per-entry counters of how often each key's
+// value is overwritten, see Cache.HotKeys.
+func WithWriteCounts() Option {
+	return func(c *Cache) {
+		c.trackWrites = true
+	}
+}
+
+// WithInsertionPolicy sets where new entries enter the recency order;
+// the default is InsertFront.
+func WithInsertionPolicy(p InsertionPolicy) Option {
+	return func(c *Cache) {
+		c.insertion = p
+	}
+}
+
+// WithExpirationIndex keeps entries with a ttl in a min-heap ordered by
+// deadline. Cleanup then only visits entries that are actually due, and
+// the watchdog sleeps until the next deadline rather than a full
+// interval, at the cost of O(log n) bookkeeping on every add and remove.
+func WithExpirationIndex() Option {
+	return func(c *Cache) {
+		c.expiry = new(expHeap)
+	}
+}
+
+// WithLockStats records write lock acquisitions and contention, see
+// Cache.LockStats. It adds a TryLock and, when contended, two clock
+// reads to every write, so it is meant for performance investigations.
+func WithLockStats() Option {
+	return func(c *Cache) {
+		c.lockStats = new(lockCounters)
+	}
+}
+
+// WithMaxKeysPerTag bounds how many keys a single tag may hold. Adding a
+// key to a full tag evicts the entry filed under it longest ago, so one
+// hot tag cannot come to reference the whole cache.
+func WithMaxKeysPerTag(n int) Option {
+	return func(c *Cache) {
+		c.maxKeysPerTag = n
+	}
+}
+
+// WithEvictOnReplace makes overwriting an existing key, by any write
+// including in-place updates and ReplaceAll, call the entry's OnEvicted
+// with the value being replaced and close it under WithCloseOnEvict, so
+// values holding resources can be released. Without it the old value is
+// dropped silently.
+func WithEvictOnReplace() Option {
+	return func(c *Cache) {
+		c.evictOnReplace = true
+	}
+}
+
+// WithCloseOnEvict makes the cache close values implementing io.Closer
+// when they leave it by eviction, expiry or Remove, after any OnEvicted
+// has run. With WithEvictOnReplace, replaced values are closed too.
+// Close errors are reported to the Logger.
+func WithCloseOnEvict() Option {
+	return func(c *Cache) {
+		c.closeOnEvict = true
+	}
+}
+
+// WithSizer measures each value added to the cache with fn, so the
+// cache can track its size in bytes, see Cache.Bytes and CacheGroup.
+func WithSizer(fn func(value interface{}) int64) Option {
+	return func(c *Cache) {
+		c.sizer = fn
+	}
+}
+
+// WithKeyCost adds fn's measure of each key to the size of its entry,
+// so the byte total reflects the memory keys occupy as well as values.
+// StringKeyCost counts string keys by length; keys fn gives no cost,
+// such as non-string keys under StringKeyCost, are counted as zero.
+// WithMaxValueSize still limits values alone.
+func WithKeyCost(fn func(key Key) int64) Option {
+	return func(c *Cache) {
+		c.keyCost = fn
+	}
+}
+
+// WithMaxValueSize rejects any value larger than n bytes, as measured by
+// the Sizer or given to AddWithSize, so one oversized value cannot push
+// everything else out of a byte budget. Storing a rejected value under
+// an existing key removes the old value.
+func WithMaxValueSize(n int64) Option {
+	return func(c *Cache) {
+		c.maxValueSize = n
+	}
+}
+
+// WithPreserveTTLOnUpdate makes replacing the value of an existing key
+// keep the entry's current deadline unless a positive ttl is given; a
+// zero ttl still removes the entry. By default every update resets the
+// deadline, and an update without a ttl, such as Add, makes the entry
+// permanent.
+func WithPreserveTTLOnUpdate() Option {
+	return func(c *Cache) {
+		c.preserveTTL = true
+	}
+}
+
+// WithNegativeTTL makes GetBatch remember, for d, the keys its loader
+// could not find, so they are not requested again in that time. Such
+// entries count toward the cache's capacity but read as misses. By
+// default missing keys are simply skipped.
+func WithNegativeTTL(d time.Duration) Option {
+	return func(c *Cache) {
+		c.negativeTTL = d
+	}
+}
+
+// WithEvictionComparator replaces LRU victim selection: when the cache
+// is over capacity the entry that is least under less is evicted. It
+// also enables the access counts and times the views report. Choosing a
+// victim scans every entry, so eviction becomes O(n) instead of O(1).
+func WithEvictionComparator(less func(a, b *EntryView) bool) Option {
+	return func(c *Cache) {
+		c.less = less
+		c.trackAccess = true
+	}
+}
+
+// WithPolicy sets the eviction policy; the default is PolicyLRU.
+func WithPolicy(p Policy) Option {
+	return func(c *Cache) {
+		c.policy = p
+		c.setClockReads()
+	}
+}
+
+// WithCanEvict consults fn before capacity eviction removes an entry,
+// letting it protect values that are in use. A vetoed entry is skipped
+// for the next candidate. If fn refuses a run of candidates the cache
+// goes over MaxEntries for this write, or with force evicts the first
+// candidate anyway. fn is called with the cache lock held and must not
+// use the cache.
+func WithCanEvict(fn func(key Key, value interface{}) bool, force bool) Option {
+	return func(c *Cache) {
+		c.canEvict = fn
+		c.forceEvict = force
+	}
+}
+
+// WithCountExpiredAsMiss folds reads that find an expired entry into
+// Stats.Misses instead of counting them separately in Stats.Expired.
+func WithCountExpiredAsMiss() Option {
+	return func(c *Cache) {
+		c.expiredAsMiss = true
+	}
+}
+
+// WithCoarseClock makes the cache compare deadlines against a clock
+// the watchdog refreshes on each wakeup instead of calling time.Now on
+// every read. This saves a clock read per operation at the cost of
+// precision: entries may be served up to one cleanup interval past
+// their deadline, and new deadlines are computed from the last tick.
+// It has no effect on caches without a watchdog.
+func WithCoarseClock() Option {
+	return func(c *Cache) {
+		c.coarse = true
+	}
+}
+
+// WithTracer traces read-through operations with t. Without it, the
+// default, tracing costs nothing.
+func WithTracer(t Tracer) Option {
+	return func(c *Cache) {
+		c.tracer = t
+	}
+}
+
+// WithStaleWhileRevalidate keeps expired entries for up to staleFor past
+// their deadline so GetStale can serve them while loader fetches a
+// fresh value in the background. Get and the other reads still treat
+// such entries as expired.
+func WithStaleWhileRevalidate(staleFor time.Duration, loader func(key Key) (interface{}, time.Duration, error)) Option {
+	return func(c *Cache) {
+		c.staleFor = staleFor
+		c.revalidate = loader
+	}
+}
+
+// WithCleanupSampleSize bounds how many entries each cleanup examines
+// for expiry, keeping sweeps of large caches short at the cost of
+// leaving some expired entries for later sweeps. By default every entry
+// is examined. It has no effect with WithExpirationIndex.
+func WithCleanupSampleSize(n int) Option {
+	return func(c *Cache) {
+		c.sampleSize = n
+	}
+}
+
+// WithOnCleanup calls fn after every cleanup, whether run by the
+// watchdog, a Scheduler or DeleteExpired, with how many entries it
+// examined, how many of them it removed and how long it held the lock.
+// fn runs after the lock is released.
+func WithOnCleanup(fn func(scanned, removed int, took time.Duration)) Option {
+	return func(c *Cache) {
+		c.onCleanup = fn
+	}
+}
+
+// WithIdleBackoff lets the watchdog sleep longer while it finds nothing
+// to remove: each sweep of an empty cache, or one that expires nothing,
+// doubles the sleep up to max, and a sweep that removes entries returns
+// it to the cleanup interval. Expired entries are still never served,
+// but may be held in memory for up to max. The watchdog always skips
+// the sweep itself when the cache is empty.
+func WithIdleBackoff(max time.Duration) Option {
+	return func(c *Cache) {
+		c.idleBackoff = max
+	}
+}
+
+// WithAdaptiveInterval lets the watchdog tune its sleep to the share of
+// entries each sweep finds expired, starting from the cleanup interval:
+// a sweep that removes nothing doubles the sleep, up to max, as
+// WithIdleBackoff does, and one that finds at least a quarter of the
+// entries it examines expired halves it, down to min. Other sweeps
+// leave it unchanged. CleanupInterval reports the current sleep.
+func WithAdaptiveInterval(min, max time.Duration) Option {
+	return func(c *Cache) {
+		c.minInterval, c.idleBackoff = min, max
+	}
+}
+
+// WithOnEvictTimeout bounds how long a write waits for each of the
+// callbacks it runs after releasing the lock, such as OnEvicted and the
+// SetOnExpired hook, so one hung callback cannot stall the writer. Each
+// callback then runs on its own goroutine; one still running after d is
+// logged at info level and no longer waited for. Go cannot stop a
+// goroutine, so an abandoned callback keeps running, and holding
+// whatever it holds, until it returns, and it may still be running
+// when later callbacks start. The sink set with WithEvictionSink is not
+// bounded.
+func WithOnEvictTimeout(d time.Duration) Option {
+	return func(c *Cache) {
+		c.evictTimeout = d
+	}
+}
+
+// WithEvictionSink makes every write that removes entries, such as
+// Resize, ReplaceAll, DeleteExpired or InvalidateTag, pass all of them
+// to fn in one slice once it has released the lock, in the order they
+// were removed, so they can be handled in a batch. fn is called in
+// addition to OnEvicted and after it, and owns the slice.
+func WithEvictionSink(fn func(evicted []Evicted)) Option {
+	return func(c *Cache) {
+		c.sink = fn
+	}
+}
+
+// WithExpiredThreshold makes the cache sweep expired entries as soon as
+// it has come across n of them since the last sweep, rather than
+// waiting for the next tick of the watchdog, bounding how many dead
+// entries pile up between sweeps of a long cleanup interval. Expired
+// entries are noticed when reads find them and when the least recently
+// used entry has expired as a new key is added, so the count is an
+// estimate.
+func WithExpiredThreshold(n int) Option {
+	return func(c *Cache) {
+		c.maxExpired = n
+	}
+}
+
+// WithFailFastLoads makes GetOrCompute return ErrLoadInProgress instead
+// of waiting when another caller is already loading the key, for
+// callers that would rather treat the key as a miss than block.
+func WithFailFastLoads() Option {
+	return func(c *Cache) {
+		c.failFast = true
+	}
+}
@@ -0,0 +1,211 @@
+package kutta
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"reflect"
+	"time"
+)
+
+// persisted is the gob representation of one live entry. TTL is the
+// time the entry had left when it was saved, or zero for none.
+type persisted struct {
+	Key   Key
+	Value interface{}
+	TTL   time.Duration
+}
+
+// Save writes the live entries of the cache to w using gob, from least
+// to most recently used, with the ttl each has remaining.
+//
+// Keys and values are encoded as interfaces, so any type other than
+// gob's predeclared basic types must be registered with gob.Register
+// before calling Save or Load. OnEvicted callbacks are not saved.
+//
+// Entries whose key or value is a func, chan or unsafe.Pointer, or a
+// pointer, slice, array or map of one, cannot be represented by gob;
+// Save skips them, reporting each to the Logger, instead of failing the
+// whole dump. Struct fields of those kinds are silently dropped by gob
+// itself. Every other cache operation stores such values untouched.
+func (c *Cache) Save(w io.Writer) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return ErrClosed
+	}
+	items := c.persisted()
+	c.mu.RUnlock()
+	return gob.NewEncoder(w).Encode(items)
+}
+
+func (c *Cache) persisted() []persisted {
+	if c.cache == nil {
+		return nil
+	}
+	now := c.now()
+	items := make([]persisted, 0, c.dl.Len())
+	for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+		if p, ok := c.persist(ele.Value.(*entry), now); ok {
+			items = append(items, p)
+		}
+	}
+	return items
+}
+
+// persist converts kv for encoding, reporting false if it has expired
+// or cannot be encoded.
+func (c *Cache) persist(kv *entry, now int64) (persisted, bool) {
+	if kv.negative {
+		return persisted{}, false
+	}
+	if !gobbable(kv.key) || !gobbable(kv.value) {
+		c.infof("kutta: not saving key %v: key or value of type %T cannot be encoded", kv.key, kv.value)
+		return persisted{}, false
+	}
+	if c.expiredAt(kv, now) {
+		return persisted{}, false
+	}
+	p := persisted{Key: kv.key, Value: kv.value}
+	if kv.hasTTL() {
+		p.TTL = time.Duration(kv.Expiration - now)
+	}
+	return p, true
+}
+
+// streamBatch is how many entries StreamExport encodes per lock hold.
+const streamBatch = 256
+
+// StreamExport writes the live entries of the cache to w one at a time,
+// holding the read lock only while copying each small batch, so neither
+// a full copy of the values nor a long lock hold is needed. Only the
+// keys are snapshotted up front, least recently used first.
+//
+// The export is weakly consistent: entries added after it starts are
+// not included, entries removed before their batch is reached are
+// skipped, and each value is the one current when its batch is read.
+// Use StreamImport to read the result; the Save encoding rules apply.
+func (c *Cache) StreamExport(w io.Writer) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return ErrClosed
+	}
+	var keys []Key
+	if c.cache != nil {
+		keys = make([]Key, 0, c.dl.Len())
+		for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+			keys = append(keys, ele.Value.(*entry).key)
+		}
+	}
+	c.mu.RUnlock()
+
+	enc := gob.NewEncoder(w)
+	batch := make([]persisted, 0, streamBatch)
+	for len(keys) > 0 {
+		n := streamBatch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		batch = batch[:0]
+		now := c.now()
+		c.mu.RLock()
+		for _, key := range keys[:n] {
+			if ele, ok := c.cache[key]; ok {
+				if p, ok := c.persist(ele.Value.(*entry), now); ok {
+					batch = append(batch, p)
+				}
+			}
+		}
+		c.mu.RUnlock()
+		keys = keys[n:]
+		for i := range batch {
+			if err := enc.Encode(&batch[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StreamImport reads entries written by StreamExport from r until EOF
+// and adds them to the cache, taking the lock once per entry.
+func (c *Cache) StreamImport(r io.Reader) error {
+	if c.Closed() {
+		return ErrClosed
+	}
+	dec := gob.NewDecoder(r)
+	for {
+		var p persisted
+		if err := dec.Decode(&p); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		d := p.TTL
+		if d == 0 {
+			d = NoExpiration
+		}
+		c.AddEx(p.Key, p.Value, d)
+	}
+}
+
+// gobbable reports whether gob can encode x's dynamic type.
+func gobbable(x interface{}) bool {
+	if x == nil {
+		return true
+	}
+	return gobbableType(reflect.TypeOf(x))
+}
+
+func gobbableType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return gobbableType(t.Elem())
+	case reflect.Map:
+		return gobbableType(t.Key()) && gobbableType(t.Elem())
+	}
+	return true
+}
+
+// Load reads entries written by Save from r and adds them to the cache,
+// replacing any existing entries with the same keys.
+func (c *Cache) Load(r io.Reader) error {
+	var items []persisted
+	if err := gob.NewDecoder(r).Decode(&items); err != nil {
+		return err
+	}
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	for _, p := range items {
+		d := p.TTL
+		if d == 0 {
+			d = NoExpiration
+		}
+		c.add(p.Key, p.Value, d, nil)
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using Save. The same
+// type registration requirements apply; callbacks, options and the
+// watchdog are not part of the encoding.
+func (c *Cache) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using Load.
+// When it is called on a zero Cache, as gob does for a *Cache field,
+// the result has no watchdog and expires entries only when read.
+func (c *Cache) UnmarshalBinary(data []byte) error {
+	return c.Load(bytes.NewReader(data))
+}
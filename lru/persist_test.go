@@ -0,0 +1,244 @@
+package kutta
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad(t *testing.T) {
+	src := New(0, time.Hour)
+	src.Add("a", 1)
+	src.AddEx("b", "two", time.Hour)
+	src.AddEx("gone", 3, time.Hour)
+	src.expireNow("gone")
+
+	var buf bytes.Buffer
+	if err := src.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := New(0, time.Hour)
+	if err := dst.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != 2 {
+		t.Fatalf("Len = %d; want 2", dst.Len())
+	}
+	if v, ok := dst.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %v, %v; want 1, true", v, ok)
+	}
+	if v, ok := dst.Get("b"); !ok || v != "two" {
+		t.Errorf("Get(b) = %v, %v; want two, true", v, ok)
+	}
+}
+
+func TestGobContainingStruct(t *testing.T) {
+	type state struct {
+		Name  string
+		Cache *Cache
+	}
+	in := state{Name: "s", Cache: New(0, time.Hour)}
+	in.Cache.AddEx("k", "v", time.Hour)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	var out state
+	if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := out.Cache.Get("k"); !ok || v != "v" {
+		t.Fatalf("Get(k) = %v, %v; want v, true", v, ok)
+	}
+}
+
+func TestSaveSkipsFuncValues(t *testing.T) {
+	src := New(0, time.Hour)
+	src.Add("plugin", func() {})
+	src.Add("chans", []chan int{make(chan int)})
+	src.Add("plain", 1)
+
+	var buf bytes.Buffer
+	if err := src.Save(&buf); err != nil {
+		t.Fatalf("Save = %v; want unserializable entries skipped", err)
+	}
+	dst := New(0, time.Hour)
+	if err := dst.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != 1 {
+		t.Fatalf("Len = %d; want 1", dst.Len())
+	}
+	if fn, ok := src.Get("plugin"); !ok || fn.(func()) == nil {
+		t.Fatal("func value was not stored untouched")
+	}
+}
+
+func TestStreamExportImport(t *testing.T) {
+	src := New(0, time.Hour)
+	for i := 0; i < 3*streamBatch/2; i++ {
+		src.AddEx(i, i*2, time.Hour)
+	}
+	src.Add("forever", true)
+
+	var buf bytes.Buffer
+	if err := src.StreamExport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := New(0, time.Hour)
+	if err := dst.StreamImport(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Len() != src.Len() {
+		t.Fatalf("Len = %d; want %d", dst.Len(), src.Len())
+	}
+	if v, ok := dst.Get(100); !ok || v != 200 {
+		t.Errorf("Get(100) = %v, %v; want 200, true", v, ok)
+	}
+	if v, ok := dst.Get("forever"); !ok || v != true {
+		t.Errorf("Get(forever) = %v, %v; want true, true", v, ok)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	leader, follower := New(0, time.Hour), New(0, time.Hour)
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- follower.ApplyChange(r) }()
+	leader.EnableChangeLog(w)
+	leader.AddEx("a", 1, time.Hour)
+	leader.Add("b", 2)
+	leader.Add("c", 3)
+	leader.IncrementFloat("f", 1.5, time.Hour)
+	leader.IncrementFloat("f", 1, time.Hour)
+	leader.Remove("b")
+	leader.Rename("c", "d")
+	leader.EnableChangeLog(nil)
+	leader.Add("unlogged", 0)
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(follower.OrderedEntries()); got != "[d f a]" {
+		t.Fatalf("follower holds %s; want [d f a]", got)
+	}
+	want, _ := leader.ViewEntry("a")
+	if got, _ := follower.ViewEntry("a"); !got.Expiration.Equal(want.Expiration) {
+		t.Fatalf("a expires at %v on the follower; want %v", got.Expiration, want.Expiration)
+	}
+	if v, _ := follower.Get("f"); v != 2.5 {
+		t.Fatalf("f = %v on the follower; want 2.5", v)
+	}
+}
+
+func TestChangeLogNegative(t *testing.T) {
+	leader := New(0, time.Hour, WithNegativeTTL(time.Hour))
+	follower := New(0, time.Hour, WithNegativeTTL(time.Hour))
+	var buf bytes.Buffer
+	leader.EnableChangeLog(&buf)
+	none := func(ctx context.Context, missing []Key) (map[Key]interface{}, error) { return nil, nil }
+	if _, err := leader.GetBatch(context.Background(), []Key{"absent"}, none, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplyChange(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loads := 0
+	counting := func(ctx context.Context, missing []Key) (map[Key]interface{}, error) {
+		loads++
+		return nil, nil
+	}
+	if _, err := follower.GetBatch(context.Background(), []Key{"absent"}, counting, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 0 {
+		t.Fatal("follower did not replicate the negative entry")
+	}
+}
+
+// blockingWriter blocks every Write until release is closed.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.entered <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestChangeLogSlowWriter(t *testing.T) {
+	cache := New(0, time.Hour)
+	w := &blockingWriter{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	cache.EnableChangeLog(w)
+	go cache.Add("a", 1)
+	<-w.entered
+	added := make(chan struct{})
+	go func() {
+		cache.Add("b", 2)
+		close(added)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("Get(a) missed")
+	}
+	close(w.release)
+	<-added
+}
+
+func TestChangeLogModifyInPlace(t *testing.T) {
+	gob.Register(map[string]int{})
+	leader := New(0, time.Hour)
+	r, w := io.Pipe()
+	done := make(chan error)
+	follower := New(0, time.Hour)
+	go func() { done <- follower.ApplyChange(r) }()
+	leader.EnableChangeLog(w)
+	leader.Add("m", map[string]int{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				leader.Modify("m", 0, false, func(old interface{}, found bool) (interface{}, bool) {
+					m := old.(map[string]int)
+					m[fmt.Sprint(i)] = j
+					return m, true
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := follower.Get("m"); len(v.(map[string]int)) != 4 {
+		t.Fatalf("m = %v on the follower; want 4 keys", v)
+	}
+}
+
+func TestChangeLogIgnoresClose(t *testing.T) {
+	leader, follower := New(0, time.Hour), New(0, time.Hour)
+	var buf bytes.Buffer
+	leader.EnableChangeLog(&buf)
+	leader.Add("k", 1)
+	leader.Close()
+	if err := follower.ApplyChange(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := follower.Get("k"); !ok {
+		t.Fatal("leader's Close cleared the follower")
+	}
+}
@@ -0,0 +1,359 @@
+package kutta
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// An EntryView is a read-only copy of the metadata of one entry, given
+// to eviction comparators.
+type EntryView struct {
+	Key        Key
+	Accesses   uint64    // reads by Get since the entry was added
+	LastAccess time.Time // last read by Get, or when it was added
+	Inserted   time.Time // when the entry was added
+	Size       int64     // see Cache.Bytes
+	Priority   int       // see Cache.SetPriority
+}
+
+// EntryInfo is everything the cache knows about one entry.
+type EntryInfo struct {
+	EntryView
+	Value      interface{}
+	Expiration time.Time     // zero if the entry does not expire
+	TTL        time.Duration // time left until Expiration, or NoExpiration
+	Version    uint64        // see Cache.GetWithVersion
+}
+
+// ViewEntry returns everything known about key, or the entry it
+// aliases, without promoting it or counting an access. Access counts
+// and times are only maintained with WithAccessCount or
+// WithEvictionComparator.
+func (c *Cache) ViewEntry(key Key) (EntryInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ele, hit := c.element(key)
+	if !hit {
+		return EntryInfo{}, false
+	}
+	kv := ele.Value.(*entry)
+	if kv.negative || c.expired(kv) {
+		return EntryInfo{}, false
+	}
+	info := EntryInfo{EntryView: kv.view(), Value: kv.value, Version: kv.version}
+	info.TTL = NoExpiration
+	if kv.hasTTL() {
+		info.Expiration = time.Unix(0, kv.Expiration)
+		info.TTL = time.Duration(kv.Expiration - c.now())
+	}
+	return info, true
+}
+
+func (e *entry) view() EntryView {
+	return EntryView{
+		Key:        e.key,
+		Accesses:   e.accesses,
+		LastAccess: time.Unix(0, e.lastAccess),
+		Inserted:   time.Unix(0, e.inserted),
+		Size:       e.size,
+		Priority:   e.priority,
+	}
+}
+
+// A Policy selects how the cache picks entries to evict.
+type Policy int
+
+const (
+	// PolicyLRU evicts the least recently used entry.
+	PolicyLRU Policy = iota
+	// PolicySLRU is segmented LRU: new entries start in a probationary
+	// segment and join a protected segment, of up to 80% of MaxEntries,
+	// only when read again. Eviction takes the least recently used
+	// probationary entry, so a scan of one-off keys cannot flush out
+	// entries that are read repeatedly. Both segments share one list,
+	// so finding the victim skips over protected entries at its tail.
+	PolicySLRU
+	// PolicyClock approximates LRU with the CLOCK, or second chance,
+	// algorithm: a read only sets a reference bit on the entry instead
+	// of moving it in the list, so Get runs under the shared read lock.
+	// Eviction sweeps a hand from the oldest entry, clearing reference
+	// bits, and evicts the first entry whose bit was clear.
+	PolicyClock
+)
+
+// An InsertionPolicy selects where new entries enter the recency order.
+type InsertionPolicy int
+
+const (
+	// InsertFront makes a new entry the most recently used.
+	InsertFront InsertionPolicy = iota
+	// InsertProbation makes a new entry the least recently used, so it is
+	// the next to be evicted unless it is read before another key is
+	// added. A scan of one-off keys then cycles through a single slot
+	// instead of flushing out entries that are read repeatedly; the cost
+	// is that a new entry must be read promptly to stay.
+	InsertProbation
+)
+
+// Policy returns the cache's eviction policy.
+func (c *Cache) Policy() Policy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.policy
+}
+
+// SetPolicy switches the eviction policy of a live cache, for example
+// to compare policies on real traffic. Switching clears the SLRU
+// protected segment, so under PolicySLRU every entry starts out
+// probationary and must be read again to be protected; this takes O(n)
+// time. A comparator set with WithEvictionComparator still takes
+// precedence over the policy.
+func (c *Cache) SetPolicy(p Policy) {
+	c.lock()
+	defer c.unlock()
+	if p == c.policy {
+		return
+	}
+	c.policy = p
+	c.setClockReads()
+	c.hand = nil
+	if c.protected == 0 {
+		return
+	}
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		ele.Value.(*entry).protected = false
+	}
+	c.protected = 0
+}
+
+// setClockReads records whether the policy is PolicyClock for Get.
+func (c *Cache) setClockReads() {
+	var v uint32
+	if c.policy == PolicyClock {
+		v = 1
+	}
+	atomic.StoreUint32(&c.clockReads, v)
+}
+
+// sweepHand advances the PolicyClock hand from the oldest entry towards
+// the newest, wrapping around, and returns the first evictable entry
+// with a clear reference bit, clearing the bits it passes. After two
+// turns every bit has been cleared, so it gives up only if no entry may
+// be evicted at all.
+func (c *Cache) sweepHand(skip map[*list.Element]bool) *list.Element {
+	for n := 2*c.dl.Len() + 1; n > 0; n-- {
+		ele := c.hand
+		if ele == nil {
+			ele = c.dl.Back()
+			if ele == nil {
+				return nil
+			}
+		}
+		c.hand = ele.Prev()
+		kv := ele.Value.(*entry)
+		if kv.pinned || skip[ele] {
+			continue
+		}
+		if atomic.SwapUint32(&kv.referenced, 0) == 0 {
+			return ele
+		}
+	}
+	return nil
+}
+
+// protectedCap is the size of the SLRU protected segment.
+func (c *Cache) protectedCap() int {
+	return c.MaxEntries * 4 / 5
+}
+
+// protect moves e into the SLRU protected segment on a repeat read,
+// demoting the least recently used protected entry to the head of the
+// probationary segment if the protected segment is full.
+func (c *Cache) protect(e *entry) {
+	if e.protected {
+		return
+	}
+	e.protected = true
+	c.protected++
+	if c.MaxEntries == 0 || c.protected <= c.protectedCap() {
+		return
+	}
+	for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+		if kv := ele.Value.(*entry); kv.protected && kv != e {
+			kv.protected = false
+			c.protected--
+			c.dl.MoveToFront(ele)
+			return
+		}
+	}
+}
+
+// victim returns the entry capacity eviction should remove: the least
+// entry under the comparator set with WithEvictionComparator if there
+// is one, otherwise the choice of the cache's Policy. Pinned entries
+// are never chosen, and entries the WithCanEvict hook vetoes are passed
+// over for the next candidate, up to maxVetoes of them. victim returns
+// nil if no entry may be evicted.
+func (c *Cache) victim() *list.Element {
+	var (
+		vetoed map[*list.Element]bool
+		first  *list.Element
+	)
+	for len(vetoed) < maxVetoes {
+		ele := c.candidate(vetoed)
+		if ele == nil {
+			break
+		}
+		kv := ele.Value.(*entry)
+		if c.canEvict == nil || c.canEvict(kv.key, kv.value) {
+			return ele
+		}
+		if first == nil {
+			first = ele
+			vetoed = make(map[*list.Element]bool)
+		}
+		vetoed[ele] = true
+	}
+	if c.forceEvict {
+		return first
+	}
+	return nil
+}
+
+// maxVetoes bounds how many candidates a single eviction offers to the
+// WithCanEvict hook, so a hook refusing everything cannot make each
+// write walk the whole cache.
+const maxVetoes = 16
+
+// candidate chooses a victim as victim does, ignoring the WithCanEvict
+// hook and skipping the entries in skip.
+func (c *Cache) candidate(skip map[*list.Element]bool) *list.Element {
+	if c.less == nil {
+		if c.policy == PolicyClock {
+			return c.sweepHand(skip)
+		}
+		if c.policy == PolicySLRU {
+			for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+				if kv := ele.Value.(*entry); !kv.protected && !kv.pinned && !skip[ele] {
+					return ele
+				}
+			}
+		}
+		for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+			if !ele.Value.(*entry).pinned && !skip[ele] {
+				return ele
+			}
+		}
+		return nil
+	}
+	var (
+		best *list.Element
+		bv   EntryView
+	)
+	for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+		kv := ele.Value.(*entry)
+		if kv.pinned || skip[ele] {
+			continue
+		}
+		v := kv.view()
+		if best == nil || c.less(&v, &bv) {
+			best, bv = ele, v
+		}
+	}
+	return best
+}
+
+// oldestUnpinned returns the least recently used entry that is not
+// pinned, or nil.
+func (c *Cache) oldestUnpinned() *list.Element {
+	for ele := c.dl.Back(); ele != nil; ele = ele.Prev() {
+		if !ele.Value.(*entry).pinned {
+			return ele
+		}
+	}
+	return nil
+}
+
+// Pin exempts key from capacity eviction and RemoveOldest until Unpin is
+// called; it can still expire and be removed explicitly. A cache whose
+// entries are all pinned grows past MaxEntries. Pin reports false if
+// key is not in the cache.
+func (c *Cache) Pin(key Key) bool {
+	return c.setPinned(key, true)
+}
+
+// Unpin makes key evictable again. It reports false if key is not in
+// the cache.
+func (c *Cache) Unpin(key Key) bool {
+	return c.setPinned(key, false)
+}
+
+func (c *Cache) setPinned(key Key, pinned bool) bool {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if !hit {
+		return false
+	}
+	ele.Value.(*entry).pinned = pinned
+	return true
+}
+
+// evict removes the victim chosen by victim and returns it, or nil if
+// the cache is empty.
+func (c *Cache) evict() *entry {
+	if c.cache == nil {
+		return nil
+	}
+	ele := c.victim()
+	if ele == nil {
+		return nil
+	}
+	c.drop(ele, ReasonCapacity)
+	return ele.Value.(*entry)
+}
+
+// shed evicts one entry as capacity eviction would, reporting false if
+// there was nothing to evict. It is called by CacheGroup.enforce, which
+// goes on evicting while the group is over budget, so it releases the
+// lock without enforcing the budget again.
+func (c *Cache) shed() bool {
+	c.lock()
+	defer c.unlockLocal()
+	return c.evict() != nil
+}
+
+// SetPriority sets the priority comparators see for key. It reports
+// false if key is not in the cache.
+func (c *Cache) SetPriority(key Key, priority int) bool {
+	c.lock()
+	defer c.unlock()
+	ele, hit := c.element(key)
+	if !hit {
+		return false
+	}
+	ele.Value.(*entry).priority = priority
+	return true
+}
+
+// An EvictionReason says why an entry left the cache.
+type EvictionReason int
+
+const (
+	// ReasonRemoved entries were removed explicitly, by Remove,
+	// InvalidateTag, InvalidateAll, ReplaceAll and the like.
+	ReasonRemoved EvictionReason = iota
+	// ReasonCapacity entries were evicted to make room.
+	ReasonCapacity
+	// ReasonExpired entries outlived their ttl.
+	ReasonExpired
+)
+
+// Evicted is an entry that left the cache, as given to the sink set
+// with WithEvictionSink.
+type Evicted struct {
+	Key    Key
+	Value  interface{}
+	Reason EvictionReason
+}
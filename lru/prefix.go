@@ -0,0 +1,62 @@
+package kutta
+
+import (
+	"container/list"
+	"strings"
+)
+
+// KeysWithPrefix returns the live string keys beginning with prefix,
+// most recently used first. Keys of other types never match.
+func (c *Cache) KeysWithPrefix(prefix string) []Key {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var keys []Key
+	c.eachPrefixed(prefix, func(ele *list.Element) {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expired(kv) {
+			keys = append(keys, kv.key)
+		}
+	})
+	return keys
+}
+
+// CountWithPrefix returns how many live string keys begin with prefix.
+func (c *Cache) CountWithPrefix(prefix string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := 0
+	c.eachPrefixed(prefix, func(ele *list.Element) {
+		if kv := ele.Value.(*entry); !kv.negative && !c.expired(kv) {
+			n++
+		}
+	})
+	return n
+}
+
+// RemovePrefix removes every entry whose key is a string beginning with
+// prefix, calling OnEvicted for each, and returns how many it removed.
+// The removal is atomic with respect to other operations.
+func (c *Cache) RemovePrefix(prefix string) int {
+	c.lock()
+	defer c.unlock()
+	var matched []*list.Element
+	c.eachPrefixed(prefix, func(ele *list.Element) {
+		matched = append(matched, ele)
+	})
+	for _, ele := range matched {
+		c.removeElement(ele)
+	}
+	return len(matched)
+}
+
+// eachPrefixed calls fn for each entry, most recent first, whose key is
+// a string beginning with prefix.
+func (c *Cache) eachPrefixed(prefix string, fn func(ele *list.Element)) {
+	if c.cache == nil {
+		return
+	}
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		if s, ok := ele.Value.(*entry).key.(string); ok && strings.HasPrefix(s, prefix) {
+			fn(ele)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package kutta
+
+import "time"
+
+// A ReadOnlyCache is the reading half of a Cache, for handing to code
+// that must not add, remove or clear entries. Get still counts as a use
+// for eviction and statistics.
+type ReadOnlyCache interface {
+	Get(key Key) (value interface{}, ok bool)
+	GetFresh(key Key, maxAge time.Duration) (interface{}, bool)
+	Lookup(key Key) Result
+	ViewEntry(key Key) (EntryInfo, bool)
+	ContainsAll(keys []Key) bool
+	ContainsAny(keys []Key) bool
+	Len() int
+	Bytes() int64
+	OrderedEntries() []Key
+	KeysWithPrefix(prefix string) []Key
+	CountFunc(match func(key Key, value interface{}) bool) int
+	NextExpiration() (time.Time, bool)
+	Iterator() *Iterator
+	Stats() Stats
+}
+
+// readOnly hides the Cache behind a ReadOnlyCache, so a type assertion
+// cannot recover its writing methods.
+type readOnly struct {
+	ReadOnlyCache
+}
+
+// ReadOnly returns a read-only view of the cache. It shares the cache's
+// entries, so writes through c are seen through the view.
+func (c *Cache) ReadOnly() ReadOnlyCache {
+	return readOnly{c}
+}
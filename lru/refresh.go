@@ -0,0 +1,117 @@
+package kutta
+
+import (
+	"sync"
+	"time"
+)
+
+// EnableBackgroundRefresh starts a goroutine that every threshold/2
+// finds the live entries due to expire within threshold and reloads
+// them with loader, at most concurrency at a time, storing each result
+// with the ttl the loader returned, so that read-heavy keys never
+// expire. Keys already being loaded, by an earlier pass or by
+// GetOrCompute or GetStale, are skipped. Failed reloads are logged and
+// leave the entry to expire. Calling it again replaces the previous
+// refresher, and Close stops it. A threshold under 2ns leaves no
+// interval to wake at, so it is rejected: the call is reported to the
+// Logger and changes nothing.
+func (c *Cache) EnableBackgroundRefresh(threshold time.Duration, concurrency int,
+	loader func(key Key) (interface{}, time.Duration, error)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	stop := make(chan struct{})
+	c.lock()
+	defer c.unlock()
+	if c.closed {
+		return
+	}
+	if threshold/2 <= 0 {
+		c.infof("kutta: not refreshing with threshold %v, it must be at least 2ns", threshold)
+		return
+	}
+	if c.refreshStop != nil {
+		close(c.refreshStop)
+	}
+	c.refreshStop = stop
+	go c.refreshLoop(threshold, concurrency, loader, stop)
+}
+
+func (c *Cache) refreshLoop(threshold time.Duration, concurrency int,
+	loader func(key Key) (interface{}, time.Duration, error), stop chan struct{}) {
+	ticker := time.NewTicker(threshold / 2)
+	defer ticker.Stop()
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, key := range c.refreshDue(threshold) {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Add(1)
+			go func(key Key) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				c.refresh(key, loader, stop)
+			}(key)
+		}
+	}
+}
+
+// refreshDue returns the live keys expiring within threshold that are
+// not being loaded already.
+func (c *Cache) refreshDue(threshold time.Duration) []Key {
+	c.mu.RLock()
+	var due []Key
+	if c.cache != nil {
+		now := c.now()
+		for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+			kv := ele.Value.(*entry)
+			if kv.hasTTL() && !kv.negative && !c.expiredAt(kv, now) &&
+				kv.Expiration-now < int64(threshold) {
+				due = append(due, kv.key)
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	idle := due[:0]
+	for _, key := range due {
+		if _, ok := c.loads[key]; !ok {
+			idle = append(idle, key)
+		}
+	}
+	return idle
+}
+
+// refresh reloads key with loader and stores the result unless the
+// refresher was stopped meanwhile.
+func (c *Cache) refresh(key Key, loader func(key Key) (interface{}, time.Duration, error), stop chan struct{}) {
+	c.load(key, func() (interface{}, error) {
+		v, d, err := loader(key)
+		if err != nil {
+			c.mu.RLock()
+			c.infof("kutta: refreshing %v: %v", key, err)
+			c.mu.RUnlock()
+			return v, err
+		}
+		select {
+		case <-stop:
+		default:
+			c.AddEx(key, v, d)
+		}
+		return v, nil
+	})
+}
@@ -0,0 +1,85 @@
+package kutta
+
+import (
+	"sync"
+	"time"
+)
+
+// A Scheduler runs expiration cleanup for many caches from a single
+// goroutine and ticker, instead of one watchdog per cache.
+type Scheduler struct {
+	Interval time.Duration
+
+	mu     sync.Mutex
+	caches map[*Cache]struct{}
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewScheduler starts a scheduler that sweeps its caches every interval.
+func NewScheduler(interval time.Duration) *Scheduler {
+	s := &Scheduler{
+		Interval: interval,
+		caches:   make(map[*Cache]struct{}),
+		stop:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// NewWithScheduler creates a cache without its own watchdog whose
+// expired entries are instead removed by sched. The scheduler keeps the
+// cache reachable until it is unregistered or closed.
+func NewWithScheduler(maxEntries int, sched *Scheduler, opts ...Option) *Cache {
+	c := NewLazy(maxEntries, opts...)
+	c.sched = sched
+	sched.Register(c)
+	return c
+}
+
+// Register adds c to the caches swept by s.
+func (s *Scheduler) Register(c *Cache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.caches[c] = struct{}{}
+}
+
+// Unregister stops s from sweeping c.
+func (s *Scheduler) Unregister(c *Cache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.caches, c)
+}
+
+// Stop ends the scheduler's goroutine. Registered caches keep working
+// but expire entries only when they are read.
+func (s *Scheduler) Stop() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) sweep() {
+	s.mu.Lock()
+	caches := make([]*Cache, 0, len(s.caches))
+	for c := range s.caches {
+		caches = append(caches, c)
+	}
+	s.mu.Unlock()
+	for _, c := range caches {
+		if !c.cleanupPaused() {
+			c.DeleteExpired()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package kutta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	sched := NewScheduler(10 * time.Millisecond)
+	defer sched.Stop()
+	a := NewWithScheduler(0, sched, WithExpirationIndex())
+	b := NewWithScheduler(0, sched, WithExpirationIndex())
+	if a.WatchDog != nil || b.WatchDog != nil {
+		t.Fatal("scheduled cache started its own watchdog")
+	}
+	a.AddEx("k", 1, time.Hour)
+	b.AddEx("k", 2, time.Hour)
+	a.expireNow("k")
+	b.expireNow("k")
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Len()+b.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if a.Len()+b.Len() != 0 {
+		t.Fatal("scheduler did not sweep registered caches")
+	}
+
+	sched.Unregister(b)
+	b.AddEx("k", 2, time.Hour)
+	b.expireNow("k")
+	time.Sleep(50 * time.Millisecond)
+	if b.Len() != 1 {
+		t.Fatal("scheduler swept an unregistered cache")
+	}
+}
@@ -0,0 +1,64 @@
+package kutta
+
+import "time"
+
+// An ExpiringSet remembers members for a limited time, e.g. to
+// deduplicate messages or track idempotency keys. It is a Cache whose
+// values are ignored, so capacity, eviction and options behave the same.
+type ExpiringSet struct {
+	c *Cache
+}
+
+// NewExpiringSet creates a set holding at most maxMembers members, zero
+// meaning no limit, cleaned up every cleanupInterval as New does.
+func NewExpiringSet(maxMembers int, cleanupInterval time.Duration, opts ...Option) *ExpiringSet {
+	return &ExpiringSet{c: New(maxMembers, cleanupInterval, opts...)}
+}
+
+// Add inserts member for ttl, or refreshes its ttl if it is present. A
+// negative ttl keeps it until it is removed or evicted, and a zero ttl
+// removes it, as with Cache.AddEx.
+func (s *ExpiringSet) Add(member Key, ttl time.Duration) {
+	s.c.AddEx(member, struct{}{}, ttl)
+}
+
+// Contains reports whether member is present and unexpired. It does not
+// count as a use of member for eviction.
+func (s *ExpiringSet) Contains(member Key) bool {
+	s.c.mu.RLock()
+	defer s.c.mu.RUnlock()
+	return s.c.live(member) != nil
+}
+
+// Remove deletes member.
+func (s *ExpiringSet) Remove(member Key) {
+	s.c.Remove(member)
+}
+
+// Len returns the number of members, including expired ones that have
+// not been cleaned up yet.
+func (s *ExpiringSet) Len() int {
+	return s.c.Len()
+}
+
+// Members returns the unexpired members, most recently added first.
+func (s *ExpiringSet) Members() []Key {
+	s.c.mu.RLock()
+	defer s.c.mu.RUnlock()
+	if s.c.cache == nil {
+		return nil
+	}
+	now := s.c.now()
+	members := make([]Key, 0, s.c.dl.Len())
+	for ele := s.c.dl.Front(); ele != nil; ele = ele.Next() {
+		if kv := ele.Value.(*entry); !s.c.expiredAt(kv, now) {
+			members = append(members, kv.key)
+		}
+	}
+	return members
+}
+
+// Close releases the set's watchdog, see Cache.Close.
+func (s *ExpiringSet) Close() {
+	s.c.Close()
+}
@@ -0,0 +1,28 @@
+package kutta
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringSet(t *testing.T) {
+	s := NewExpiringSet(0, time.Hour)
+	defer s.Close()
+	s.Add("a", time.Hour)
+	s.Add("b", time.Hour)
+	s.Add("c", 0)
+	if !s.Contains("a") || s.Contains("missing") {
+		t.Fatal("Contains gave the wrong answer")
+	}
+	s.c.expireNow("b")
+	if s.Contains("b") {
+		t.Fatal("Contains reported an expired member")
+	}
+	s.Remove("c")
+	if m := s.Members(); len(m) != 1 || m[0] != "a" {
+		t.Fatalf("Members = %v; want [a]", m)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("Len = %d; want 2 including the unswept expired member", s.Len())
+	}
+}
@@ -0,0 +1,34 @@
+package kutta
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// FlushOnSignal clears the cache every time the process receives sig,
+// e.g. syscall.SIGHUP. The returned stop function stops relaying sig to
+// the cache and ends the listening goroutine; it is safe to call more
+// than once.
+func (c *Cache) FlushOnSignal(sig os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				c.Clear()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
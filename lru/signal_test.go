@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+
+package kutta
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFlushOnSignal(t *testing.T) {
+	cache := New(0, time.Hour)
+	cache.Add("k", "v")
+	stop := cache.FlushOnSignal(syscall.SIGUSR1)
+	defer stop()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if cache.Len() != 0 {
+		t.Fatal("cache was not flushed on signal")
+	}
+	stop()
+}
@@ -0,0 +1,214 @@
+package kutta
+
+import (
+	"container/list"
+	"sort"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Stats counts the outcomes of reads. Every read through Get, GetIf,
+// GetWithVersion or GetBatch counts once:
+//
+//   - Hits: a live entry was returned.
+//   - Expired: an entry was found but had expired; it is removed. With
+//     WithCountExpiredAsMiss these count as Misses instead.
+//   - Misses: no entry, a key the loader reported missing, or, for
+//     GetIf, a value that failed validation.
+type Stats struct {
+	Hits    uint64
+	Misses  uint64
+	Expired uint64
+}
+
+// HitRatio returns the fraction of reads that were hits, or zero if
+// there were none.
+func (s Stats) HitRatio() float64 {
+	total := s.Hits + s.Misses + s.Expired
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+type statCounters struct {
+	hits    uint64
+	misses  uint64
+	expired uint64
+}
+
+// Stats returns the read counters accumulated since the cache was
+// created or its stats were last reset.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:    atomic.LoadUint64(&c.stats.hits),
+		Misses:  atomic.LoadUint64(&c.stats.misses),
+		Expired: atomic.LoadUint64(&c.stats.expired),
+	}
+}
+
+// ResetStats zeroes the read counters.
+func (c *Cache) ResetStats() {
+	atomic.StoreUint64(&c.stats.hits, 0)
+	atomic.StoreUint64(&c.stats.misses, 0)
+	atomic.StoreUint64(&c.stats.expired, 0)
+}
+
+func (c *Cache) countHit() {
+	atomic.AddUint64(&c.stats.hits, 1)
+}
+
+func (c *Cache) countMiss() {
+	atomic.AddUint64(&c.stats.misses, 1)
+}
+
+// countExpired records a read that found an expired entry. The write
+// lock must be held.
+func (c *Cache) countExpired() {
+	c.noteExpired()
+	if c.expiredAsMiss {
+		c.countMiss()
+		return
+	}
+	atomic.AddUint64(&c.stats.expired, 1)
+}
+
+// AgeStats summarizes how long the live entries have been in the cache
+// and how many of them expire, to help tune ttls.
+type AgeStats struct {
+	MeanAge, P50Age, P95Age time.Duration
+	WithTTL, Permanent      int // live entries with and without a deadline
+}
+
+// AgeStats scans the live entries, measuring each one's age from when it
+// was added. It takes O(n log n) time under the read lock and is meant
+// for occasional diagnostic calls.
+func (c *Cache) AgeStats() AgeStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var st AgeStats
+	if c.cache == nil {
+		return st
+	}
+	now := c.now()
+	ages := make([]time.Duration, 0, c.dl.Len())
+	var total time.Duration
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if kv.negative || c.expiredAt(kv, now) {
+			continue
+		}
+		if kv.hasTTL() {
+			st.WithTTL++
+		} else {
+			st.Permanent++
+		}
+		age := time.Duration(now - kv.inserted)
+		ages = append(ages, age)
+		total += age
+	}
+	if len(ages) == 0 {
+		return st
+	}
+	sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+	st.MeanAge = total / time.Duration(len(ages))
+	st.P50Age = ages[len(ages)*50/100]
+	st.P95Age = ages[len(ages)*95/100]
+	return st
+}
+
+// KeyWrites is a key and how many times its value was overwritten.
+type KeyWrites struct {
+	Key    Key
+	Writes uint64
+}
+
+// HotKeys returns the n live keys overwritten most often since they were
+// added, most overwritten first, to find keys whose write churn causes
+// contention. Keys never overwritten are left out. It returns nil if n
+// is not positive or the cache was not created with WithWriteCounts,
+// and takes O(m log m) time for m overwritten keys.
+func (c *Cache) HotKeys(n int) []KeyWrites {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if n <= 0 || !c.trackWrites || c.cache == nil {
+		return nil
+	}
+	now := c.now()
+	var hot []KeyWrites
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		if kv.writes == 0 || kv.negative || c.expiredAt(kv, now) {
+			continue
+		}
+		hot = append(hot, KeyWrites{kv.key, kv.writes})
+	}
+	sort.SliceStable(hot, func(i, j int) bool { return hot[i].Writes > hot[j].Writes })
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+// ExpirationHistogram counts the live entries by time left until they
+// expire, in buckets of the given width: key i counts the entries
+// expiring between i and i+1 buckets from now, and key -1 counts those
+// without a deadline. It scans the whole cache, taking O(n) time, and is
+// meant for diagnostics such as spotting many entries that expire at
+// once. It returns nil if bucket is not positive.
+func (c *Cache) ExpirationHistogram(bucket time.Duration) map[int]int {
+	if bucket <= 0 {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := make(map[int]int)
+	if c.cache == nil {
+		return h
+	}
+	now := c.now()
+	for ele := c.dl.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		switch {
+		case kv.negative || c.expiredAt(kv, now):
+		case !kv.hasTTL():
+			h[-1]++
+		default:
+			h[int((kv.Expiration-now)/int64(bucket))]++
+		}
+	}
+	return h
+}
+
+// mapSlotBytes estimates what one slot of the entry map costs: an
+// interface key, an element pointer and a hash byte, divided by the
+// load factor at which Go maps grow, 6.5 of 8 slots.
+const mapSlotBytes = (int64(unsafe.Sizeof(Key(nil))) + int64(unsafe.Sizeof((*list.Element)(nil))) + 1) * 16 / 13
+
+// ApproxMemoryBytes estimates the memory held by the cache: each entry's
+// bookkeeping and list node, the entry map, which keeps the size of its
+// high-water mark until ShrinkIfSparse, the expiration index, and the
+// sizes of keys and values as counted by Bytes. Without WithSizer,
+// AddWithSize or WithKeyCost, keys and values count only as the
+// interface words in the entry. It is a rough estimate for monitoring:
+// it ignores allocator overhead, tags, aliases and anything values
+// share.
+func (c *Cache) ApproxMemoryBytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := int64(c.len())
+	if n == 0 {
+		return 0
+	}
+	perEntry := int64(unsafe.Sizeof(entry{})) + int64(unsafe.Sizeof(list.Element{}))
+	slots := n
+	if int64(c.peak) > slots {
+		slots = int64(c.peak)
+	}
+	total := n*perEntry + slots*mapSlotBytes + c.bytes
+	if c.expiry != nil {
+		total += int64(c.expiry.Len()) * int64(unsafe.Sizeof((*entry)(nil)))
+	}
+	return total
+}
@@ -0,0 +1,81 @@
+package kutta
+
+import (
+	"container/list"
+	"time"
+)
+
+// AddWithTags is like AddEx but also files key under each of tags, so it
+// can later be removed with InvalidateTag. Tags accumulate across calls
+// and are dropped when the entry leaves the cache.
+func (c *Cache) AddWithTags(key Key, value interface{}, d time.Duration, tags ...string) {
+	c.lock()
+	defer c.unlock()
+	c.add(key, value, d, nil)
+	if ele, ok := c.cache[key]; ok {
+		c.tag(ele.Value.(*entry), tags)
+	}
+}
+
+// InvalidateTag removes every entry filed under tag, firing OnEvicted for
+// each, and returns how many were removed.
+func (c *Cache) InvalidateTag(tag string) int {
+	c.lock()
+	defer c.unlock()
+	l := c.tags[tag]
+	if l == nil {
+		return 0
+	}
+	n := 0
+	for l.Len() > 0 {
+		c.removeElement(c.cache[l.Front().Value.(*entry).key])
+		n++
+	}
+	return n
+}
+
+// tag adds e to each of tags, most recent first, and enforces the per
+// tag key limit by evicting the entry filed under the tag longest ago.
+func (c *Cache) tag(e *entry, tags []string) {
+	if c.tags == nil {
+		c.tags = make(map[string]*list.List)
+	}
+	for _, t := range tags {
+		if te, ok := e.tags[t]; ok {
+			c.tags[t].MoveToFront(te)
+			continue
+		}
+		l := c.tags[t]
+		if l == nil {
+			l = list.New()
+			c.tags[t] = l
+		}
+		if e.tags == nil {
+			e.tags = make(map[string]*list.Element)
+		}
+		e.tags[t] = l.PushFront(e)
+		if c.maxKeysPerTag > 0 && l.Len() > c.maxKeysPerTag {
+			c.removeElement(c.cache[l.Back().Value.(*entry).key])
+		}
+	}
+}
+
+// untag removes e from every tag it is filed under.
+func (c *Cache) untag(e *entry) {
+	for t, te := range e.tags {
+		l := c.tags[t]
+		l.Remove(te)
+		if l.Len() == 0 {
+			delete(c.tags, t)
+		}
+	}
+	e.tags = nil
+}
+
+// retag transfers from's tag memberships to to, which replaces it.
+func (c *Cache) retag(from, to *entry) {
+	for _, te := range from.tags {
+		te.Value = to
+	}
+	to.tags, from.tags = from.tags, nil
+}
@@ -0,0 +1,39 @@
+package kutta
+
+import "context"
+
+// Tracer starts spans around the cache's read-through operations,
+// letting them appear in distributed traces without the cache depending
+// on a tracing library. An adapter for OpenTelemetry or similar
+// implements it on top of that library's tracer.
+//
+// Operations start a span named after themselves, such as
+// "kutta.GetOrCompute", and on a miss a child span named "kutta.load"
+// covering the loader call, so its duration is the load latency. key is
+// nil for operations on several keys. GetOrCompute takes no context, so
+// its spans start from context.Background.
+type Tracer interface {
+	Start(ctx context.Context, name string, key Key) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetHit records whether the operation was served from the cache.
+	SetHit(hit bool)
+	// End finishes the span; err is the operation's error, if any.
+	End(err error)
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetHit(bool) {}
+func (nopSpan) End(error)   {}
+
+// trace starts a span with the cache's tracer, or a no-op span if it
+// has none.
+func (c *Cache) trace(ctx context.Context, name string, key Key) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return c.tracer.Start(ctx, name, key)
+}